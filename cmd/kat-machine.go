@@ -6,6 +6,7 @@ import (
 	"github.com/conductant/gohm/pkg/command"
 	"github.com/conductant/gohm/pkg/resource"
 	"github.com/conductant/gohm/pkg/runtime"
+	"github.com/conductant/kat-machine/pkg/machine"
 	"github.com/conductant/kat-machine/pkg/server"
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
@@ -42,6 +43,7 @@ type token struct {
 	PrivateKeyUrl string        `flag:"private_key_url,The url to private key"`
 	Scopes        []string      `flag:"scope, The auth scope"`
 	Ttl           time.Duration `flag:"ttl,The token ttl to expiration"`
+	Subject       string        `flag:"subject,The identity of the token holder"`
 }
 
 func (t *token) Help(w io.Writer) {
@@ -57,6 +59,9 @@ func (t *token) Run(args []string, w io.Writer) error {
 	for _, scope := range t.Scopes {
 		token.Add(scope, 1)
 	}
+	if t.Subject != "" {
+		token.Add(machine.IdentityClaim, t.Subject)
+	}
 	signed, err := token.SignedString(func() []byte { return buff })
 	if err != nil {
 		return err
@@ -0,0 +1,226 @@
+package machine
+
+import (
+	"errors"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/mcnflag"
+	"golang.org/x/net/context"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrAccountCredential = errors.New("err-account-credential")
+
+	accounts     = map[string]Account{}
+	accountsLock sync.Mutex
+
+	// Directories of the store that are not providers.
+	reservedAccountNames = []string{"ca", "clusters", "schedules", "secrets", "templates"}
+)
+
+// A named provider account.  An account is used in the urls in place of the driver name,
+// and has its own machines in the store.  Create requests through an account get its
+// credentials and defaults without having to send them.
+type Account struct {
+	Driver string `json:"driver" yaml:"driver"`
+
+	// Driver flags that clients cannot set, such as the api keys.
+	Credentials map[string]interface{} `json:"credentials,omitempty" yaml:"credentials"`
+
+	// Driver flags that clients can override.
+	Defaults map[string]interface{} `json:"defaults,omitempty" yaml:"defaults"`
+
+	// Take the flags from the environment variables of the server named by the driver's
+	// flags, as docker-machine does.  Defaults and credentials take precedence.
+	FromEnv bool `json:"from_env,omitempty" yaml:"from_env"`
+}
+
+// Sets the accounts by name.  Account names cannot be driver names, and accounts must be of
+// a known driver and set only its flags.
+func SetAccounts(list map[string]Account) error {
+	for name, account := range list {
+		if _, has := driverFactories[name]; has {
+			return errors.New("err-account-is-driver:" + name)
+		}
+		if strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+			return errors.New("err-bad-account:" + name)
+		}
+		for _, reserved := range reservedAccountNames {
+			if name == reserved {
+				return errors.New("err-bad-account:" + name)
+			}
+		}
+		factory, has := driverFactories[account.Driver]
+		if !has {
+			return errors.New(ErrDriverNotFound.Error() + ":" + account.Driver)
+		}
+		_, driver := factory("", "")
+		for _, flags := range []map[string]interface{}{account.Credentials, account.Defaults} {
+			if err := validateInput(driver, jsonFlags(flags)); err != nil {
+				return errors.New(err.Error() + ":" + name)
+			}
+		}
+	}
+	accountsLock.Lock()
+	defer accountsLock.Unlock()
+	accounts = list
+	return nil
+}
+
+// Resolves the name in the url to an account.  A driver name is an account of its own with
+// nothing set.
+func resolveAccount(name string) (Account, bool) {
+	accountsLock.Lock()
+	defer accountsLock.Unlock()
+	if account, has := accounts[name]; has {
+		return account, true
+	}
+	if _, has := driverFactories[name]; has {
+		return Account{Driver: name}, true
+	}
+	return Account{}, false
+}
+
+// Tells whether the name is an account or driver, as opposed to another directory of the store.
+func isProvider(name string) bool {
+	_, has := resolveAccount(name)
+	return has
+}
+
+// The driver of the account, or "" if there is no such account.
+func accountDriver(name string) string {
+	account, _ := resolveAccount(name)
+	return account.Driver
+}
+
+// Fills in the flags of the account over the input.  Flags from the environment and the
+// defaults are overridden by the payload; credentials are not.
+func (a Account) apply(driver drivers.Driver, input jsonFlags, payload jsonFlags) error {
+	if a.FromEnv {
+		for _, flag := range driver.GetCreateFlags() {
+			if v, has := envValue(flag); has {
+				input[flag.String()] = v
+			}
+		}
+	}
+	for k, v := range a.Defaults {
+		input[k] = v
+	}
+	denied := []string{}
+	for k, v := range a.Credentials {
+		if _, has := payload[k]; has {
+			denied = append(denied, k)
+		}
+		input[k] = v
+	}
+	if len(denied) > 0 {
+		sort.Strings(denied)
+		return newStatusError(http.StatusBadRequest, ErrAccountCredential.Error()+":"+strings.Join(denied, ","))
+	}
+	return nil
+}
+
+// The value of a credential, opening it if it is a secret.
+func (a Account) credential(ctx context.Context, flag string) (string, error) {
+	v, has := a.Credentials[flag]
+	if !has {
+		return "", errors.New(ErrAccountCredential.Error() + ":" + flag)
+	}
+	if name, ok := secretRef(v); ok {
+		return openSecret(ctx, name, true)
+	}
+	s, _ := v.(string)
+	return s, nil
+}
+
+// The credentials of the account, by value, with the reference each is stored as.
+func (a Account) credentialRefs(ctx context.Context) credentialRefs {
+	refs := credentialRefs{}
+	for flag := range a.Credentials {
+		if value, err := a.credential(ctx, flag); err == nil && value != "" {
+			refs[value] = map[string]interface{}{"credential": flag}
+		}
+	}
+	return refs
+}
+
+// The value of the flag from its environment variable.
+func envValue(flag mcnflag.Flag) (interface{}, bool) {
+	var name string
+	switch f := flag.(type) {
+	case mcnflag.StringFlag:
+		name = f.EnvVar
+	case mcnflag.StringSliceFlag:
+		name = f.EnvVar
+	case mcnflag.IntFlag:
+		name = f.EnvVar
+	case mcnflag.BoolFlag:
+		name = f.EnvVar
+	}
+	if name == "" {
+		return nil, false
+	}
+	v, has := os.LookupEnv(name)
+	if !has {
+		return nil, false
+	}
+	switch flag.(type) {
+	case mcnflag.StringSliceFlag:
+		return strings.Split(v, ","), true
+	case mcnflag.IntFlag:
+		n, err := strconv.Atoi(v)
+		return n, err == nil
+	case mcnflag.BoolFlag:
+		b, err := strconv.ParseBool(v)
+		return b, err == nil
+	}
+	return v, true
+}
+
+type accountSummary struct {
+	Name        string                 `json:"name"`
+	Driver      string                 `json:"driver"`
+	Credentials []string               `json:"credentials,omitempty"`
+	Defaults    map[string]interface{} `json:"defaults,omitempty"`
+	FromEnv     bool                   `json:"from_env,omitempty"`
+}
+
+// Lists the accounts with their driver and the names of the flags they set, but not the values
+// of the credentials.
+func ListAccounts(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	accountsLock.Lock()
+	defer accountsLock.Unlock()
+
+	list := []accountSummary{}
+	for name, account := range accounts {
+		summary := accountSummary{
+			Name:     name,
+			Driver:   account.Driver,
+			Defaults: map[string]interface{}{},
+			FromEnv:  account.FromEnv,
+		}
+		for k, _ := range account.Credentials {
+			summary.Credentials = append(summary.Credentials, k)
+		}
+		sort.Strings(summary.Credentials)
+		for k, v := range account.Defaults {
+			summary.Defaults[k] = v
+		}
+		redact(summary.Defaults)
+		list = append(list, summary)
+	}
+	sort.Sort(accountsByName(list))
+	server.Marshal(resp, req, list)
+}
+
+type accountsByName []accountSummary
+
+func (l accountsByName) Len() int           { return len(l) }
+func (l accountsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l accountsByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
@@ -1,13 +1,104 @@
 package machine
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/conductant/gohm/pkg/encoding"
 	"github.com/conductant/gohm/pkg/server"
 	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/state"
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
+	"io/ioutil"
 	"net/http"
+	"regexp"
+	"time"
 )
 
+const (
+	// Header carrying the client supplied key that identifies a create request.
+	IdempotencyKeyHeader = "Idempotency-Key"
+)
+
+var (
+	ErrBadHostName = errors.New("err-bad-host-name")
+
+	// The names libmachine's host.ValidateHostName allows.  The name ends up in paths of the
+	// store and in the output of env for shells.
+	hostNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9\-\.]*$`)
+)
+
+// A request to create a machine, independent of how it arrived.
+type createRequest struct {
+	Driver         string
+	Name           string
+	IdempotencyKey string
+	Payload        []byte
+	ContentType    string
+	Wait           waitOptions
+	DryRun         bool
+
+	// The template the payload was merged with, if any.
+	Template *templateRef
+
+	// For a clone, the stored configuration of the driver that is used instead of flags,
+	// and the machine it was taken from.  The payload then only has kat-machine's fields.
+	Config map[string]interface{}
+	Source *machineRef
+}
+
+// Digest of what the request asks for, to tell a repeat from a different request.
+func (r createRequest) digest() string {
+	if r.Config == nil {
+		return payloadDigest(r.Payload)
+	}
+	buff, _ := json.Marshal(map[string]interface{}{
+		"config":  r.Config,
+		"payload": string(r.Payload),
+	})
+	return payloadDigest(buff)
+}
+
+// Configures the driver of the new machine from the flags of the payload or, for a clone,
+// from the stored configuration.
+func configureDriver(ctx context.Context, r createRequest) (drivers.Driver, createOptions, credentialRefs, error) {
+	driver, _, err := getDriver(ctx, r.Driver, r.Name)
+	if err != nil {
+		return nil, createOptions{}, nil, newStatusError(http.StatusNotFound, "err-not-found:"+r.Driver)
+	}
+	if r.Config != nil {
+		// The secrets of the original are those of the clone.
+		secrets := credentialRefs{}
+		if r.Source != nil {
+			if secrets, err = cloneRefs(ctx, r.Source.Driver, r.Source.Name); err != nil {
+				return nil, createOptions{}, nil, err
+			}
+		}
+		options, err := applyConfig(driver, r.Config, r.Payload)
+		return driver, options, secrets, err
+	}
+	input, secrets, err := readInput(ctx, r.Driver, driver, r.Payload, r.ContentType)
+	if err != nil {
+		return nil, createOptions{}, nil, err
+	}
+	options, err := takeCreateOptions(input)
+	if err != nil {
+		return nil, options, nil, newStatusError(http.StatusBadRequest, err.Error())
+	}
+	// Flags the driver does not know are ignored by it, as they always were.  A dry run
+	// points them out, since it is how a payload is checked.
+	if r.DryRun {
+		if err := validateInput(driver, input); err != nil {
+			return nil, options, nil, newStatusError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if err := driver.SetConfigFromFlags(input); err != nil {
+		return nil, options, nil, newStatusError(http.StatusBadRequest, err.Error())
+	}
+	return driver, options, secrets, nil
+}
+
 func loadDriver(ctx context.Context, resp http.ResponseWriter, req *http.Request) (string, drivers.Driver, error) {
 	driverName := server.GetUrlParameter(req, "driver")
 	hostName := server.GetUrlParameter(req, "name")
@@ -22,139 +113,553 @@ func loadDriver(ctx context.Context, resp http.ResponseWriter, req *http.Request
 	// If this driver instance is not restored from persistent store, then initialize
 	// it with the defaults from the flags and from the http post input.
 	if !restored {
-		input := jsonFlags{}
-		// Set default values from the flag definitions
-		for _, flag := range driver.GetCreateFlags() {
-			input[flag.String()] = flag.Default()
+		payload, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			server.HandleError(ctx, http.StatusBadRequest, err.Error())
+			return "", nil, err
 		}
-		// Unmarshal over the defaults
-		err = server.Unmarshal(resp, req, &input)
+		input, _, err := readInput(ctx, driverName, driver, payload, server.ContentTypeForRequest(req))
 		if err != nil {
+			renderError(ctx, err)
+			return "", nil, err
+		}
+		if _, err := takeCreateOptions(input); err != nil {
 			server.HandleError(ctx, http.StatusBadRequest, err.Error())
 			return "", nil, err
 		}
 		err = driver.SetConfigFromFlags(input)
+		if err != nil {
+			server.HandleError(ctx, http.StatusBadRequest, err.Error())
+			return "", nil, err
+		}
 	}
 
-	glog.Infoln("DRIVER=", driverToJSON(driver))
+	glog.Infoln("DRIVER=", driverToJSON(driver, redactedValues(ctx, driverName, nil)...))
+	return hostName, driver, nil
+}
 
+// Restores the driver of a machine that was created earlier.
+func restoreDriver(ctx context.Context, driverName, hostName string) (drivers.Driver, error) {
+	driver, restored, err := getDriver(ctx, driverName, hostName)
 	if err != nil {
-		server.HandleError(ctx, http.StatusBadRequest, err.Error())
-		return "", nil, err
+		glog.Warningln("Err=", err)
+		return nil, newStatusError(http.StatusNotFound, "err-not-found:"+driverName)
 	}
-	return hostName, driver, nil
+	if !restored {
+		return nil, newStatusError(http.StatusNotFound, "err-not-found:"+hostName)
+	}
+	return driver, nil
 }
 
-func CreateInstance(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
-	hostName, driver, err := loadDriver(ctx, resp, req)
+// Reads the create flags in the payload over the defaults of the driver's flags and those of
+// the account.  References to secrets are resolved; their values are returned with the
+// references so that they can be kept out of responses, logs and the store.
+func readInput(ctx context.Context, provider string, driver drivers.Driver, payload []byte, contentType string) (jsonFlags, credentialRefs, error) {
+	input := jsonFlags{}
+	// Set default values from the flag definitions
+	for _, flag := range driver.GetCreateFlags() {
+		input[flag.String()] = flag.Default()
+	}
+	own := jsonFlags{}
+	t, err := encoding.ContentTypeFromString(contentType)
+	if err != nil {
+		return nil, nil, newStatusError(http.StatusBadRequest, server.ErrBadContentType.Error())
+	}
+	if err := encoding.Unmarshal(t, bytes.NewReader(payload), &own); err != nil {
+		return nil, nil, newStatusError(http.StatusBadRequest, err.Error())
+	}
+	account, _ := resolveAccount(provider)
+	if err := account.apply(driver, input, own); err != nil {
+		return nil, nil, err
+	}
+	secrets, err := resolveSecrets(ctx, input, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	ownSecrets, err := resolveSecrets(ctx, own, false)
 	if err != nil {
+		return nil, nil, err
+	}
+	// Then the payload over the defaults
+	for k, v := range own {
+		input[k] = v
+	}
+	secrets.add(ownSecrets)
+	return input, secrets, nil
+}
+
+func CreateInstance(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	r := createRequest{
+		Driver:         server.GetUrlParameter(req, "driver"),
+		Name:           server.GetUrlParameter(req, "name"),
+		IdempotencyKey: req.Header.Get(IdempotencyKeyHeader),
+		ContentType:    server.ContentTypeForRequest(req),
+	}
+	var err error
+	if r.Wait, err = getWaitOptions(req); err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.DryRun, err = getDryRun(req); err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.Payload, err = ioutil.ReadAll(req.Body); err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
 		return
 	}
+	result, err := createMachine(ctx, r)
+	renderCreate(ctx, resp, req, result, err)
+}
+
+// Renders the result of a create.  A create that failed after the machine was created has
+// a result as well, with the error and the results of the provisioning steps.
+func renderCreate(ctx context.Context, resp http.ResponseWriter, req *http.Request, result map[string]interface{}, err error) {
+	switch {
+	case err != nil && result == nil:
+		renderError(ctx, err)
+	case err != nil:
+		resp.Header().Set("Content-Type", server.ContentTypeForResponse(req))
+		resp.WriteHeader(statusOf(err))
+		server.Marshal(resp, req, result)
+	default:
+		server.Marshal(resp, req, result)
+	}
+}
+
+func createMachine(ctx context.Context, r createRequest) (map[string]interface{}, error) {
+	driverName, hostName := r.Driver, r.Name
+	if !hostNamePattern.MatchString(hostName) {
+		return nil, newStatusError(http.StatusBadRequest, ErrBadHostName.Error()+":"+hostName)
+	}
 
-	err = driver.Create()
+	unlock := lockMachine(driverName, hostName)
+	defer unlock()
+
+	record, err := getMachineRecord(ctx, driverName, hostName)
 	if err != nil {
-		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
-		return
+		return nil, err
+	}
+
+	// A create against a machine that already exists never goes to the provider.  A repeat
+	// of the original request gets the original result, or runs the provisioning again if
+	// that is what failed; anything else is a conflict.  A dry run of such a create is left
+	// to fail the lifecycle check below, as is a create of a machine that has since been removed.
+	digest := r.digest()
+	key := r.IdempotencyKey
+	if record.Create != nil && record.Removed == nil && !r.DryRun {
+		if record.Create.Digest != digest || (key != "" && key != record.Create.IdempotencyKey) {
+			return nil, newStatusError(http.StatusConflict, "err-conflict:"+hostName)
+		}
+		if record.Create.Failed != "" {
+			return reprovisionMachine(ctx, r)
+		}
+		return record.Create.Result, nil
+	}
+	if lastState, err := getLastState(ctx, driverName, hostName); (err != nil || len(lastState) > 0) && !r.DryRun {
+		// Created before create requests were recorded, so there is nothing to compare with.
+		return nil, newStatusError(http.StatusConflict, "err-conflict:"+hostName)
+	}
+	if _, err := checkTransition(ctx, driverName, hostName, "create"); err != nil {
+		return nil, err
+	}
+
+	driver, options, secrets, err := configureDriver(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	expiry, err := newExpiry(options.TTL, options.ExpiresAt, options.ExpiryAction)
+	if err != nil {
+		return nil, err
+	}
+	if options.Protected && !hasScope(ctx, ProtectScope) {
+		return nil, newStatusError(http.StatusForbidden, ErrForbidden.Error()+":"+ProtectScope)
+	}
+	steps, err := expandSteps(options.Provision)
+	if err != nil {
+		return nil, err
+	}
+	if options.Engine != nil {
+		if err := options.Engine.Normalize(); err != nil {
+			return nil, newStatusError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if options.Cluster != "" {
+		if _, err := getCluster(ctx, options.Cluster); err != nil {
+			return nil, err
+		}
+		if options.Engine == nil {
+			return nil, newStatusError(http.StatusBadRequest, ErrNoEngine.Error()+":"+hostName)
+		}
+	}
+	probes, err := normalizeProbes(options.Health)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infoln("DRIVER=", driverToJSON(driver, redactedValues(ctx, r.Driver, secrets)...))
+
+	if r.DryRun {
+		config := redactedConfig(driver)
+		redactValues(config, redactedValues(ctx, r.Driver, secrets))
+		return map[string]interface{}{
+			"name":      hostName,
+			"driver":    driverName,
+			"dry_run":   true,
+			"protected": options.Protected,
+			"labels":    options.Labels,
+			"expiry":    expiry,
+			"template":  r.Template,
+			"clone_of":  r.Source,
+			"provision": steps,
+			"engine":    options.Engine,
+			"cluster":   options.Cluster,
+			"health":    probes,
+			"config":    config,
+		}, nil
+	}
+
+	if err := generateMachineKey(ctx, driverName, driver, hostName); err != nil {
+		return nil, err
+	}
+	ctx = withRefs(ctx, secrets)
+	err = runOperation(ctx, driverName, driver, "create", hostName, driver.Create)
+	if err != nil {
+		return nil, err
 	}
 
 	// Store the state of the driver so that in future calls we can rebuild the driver
 	// and make changes accordingly.  For example the driver can have specific instance id
 	// required by the provider's api for start / stop / terminate, etc.
-	err = saveDriver(ctx, driver, "create", hostName)
+	err = saveDriver(ctx, driverName, driver, "create", hostName)
 	if err != nil {
-		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
-		return
+		return nil, err
+	}
+
+	result := map[string]interface{}{
+		"name":   hostName,
+		"driver": driverName,
+	}
+	sshKey := newKeyRecord(ctx, driverName, driver, hostName)
+	err = updateMachineRecord(ctx, driverName, hostName, func(record *machineRecord) {
+		record.Create = &createRecord{
+			IdempotencyKey: key,
+			Digest:         digest,
+			Result:         result,
+		}
+		record.Protected = options.Protected
+		record.Labels = options.Labels
+		record.Expiry = expiry
+		record.Template = r.Template
+		record.CloneOf = r.Source
+		record.SSHKey = sshKey
+		if len(probes) > 0 {
+			record.Health = &healthRecord{Probes: probes}
+		}
+	})
+	if err != nil {
+		return nil, err
 	}
+
+	return provisionMachine(ctx, r, driver, options, steps, result)
+}
+
+// Runs the provisioning of a machine whose create failed in it again, for a repeat of the
+// create.  The options are those of the request, the driver that of the machine.
+func reprovisionMachine(ctx context.Context, r createRequest) (map[string]interface{}, error) {
+	_, options, secrets, err := configureDriver(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	driver, err := restoreDriver(ctx, r.Driver, r.Name)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := expandSteps(options.Provision)
+	if err != nil {
+		return nil, err
+	}
+	if options.Engine != nil {
+		if err := options.Engine.Normalize(); err != nil {
+			return nil, newStatusError(http.StatusBadRequest, err.Error())
+		}
+	}
+	result := map[string]interface{}{
+		"name":   r.Name,
+		"driver": r.Driver,
+	}
+	return provisionMachine(withRefs(ctx, secrets), r, driver, options, steps, result)
+}
+
+// Waits for the machine, installs the engine, runs the provisioning steps and joins the
+// cluster, as the create asks.  The record of the create has the result, which says what
+// failed if anything did.
+func provisionMachine(ctx context.Context, r createRequest, driver drivers.Driver, options createOptions,
+	steps []provisionStep, result map[string]interface{}) (map[string]interface{}, error) {
+
+	driverName, hostName := r.Driver, r.Name
+
+	// Keeps the create with what failed, so that a repeat runs the provisioning again
+	// rather than being answered as if it had succeeded.
+	failed := func(err error) (map[string]interface{}, error) {
+		result["error"] = err.Error()
+		updateMachineRecord(ctx, driverName, hostName, func(record *machineRecord) {
+			record.Create.Result = result
+			record.Create.Failed = err.Error()
+		})
+		return result, err
+	}
+	if r.Wait.needed() {
+		if err := waitFor(ctx, driverName, driver, hostName, r.Wait); err != nil {
+			return failed(newStatusError(statusOf(err), err.Error()+":"+hostName))
+		}
+	}
+	var engine *engineRecord
+	if options.Engine != nil {
+		more, e, err := engineSteps(ctx, driverName, driver, hostName, *options.Engine)
+		if err != nil {
+			return failed(err)
+		}
+		steps, engine = append(more, steps...), e
+	}
+	if len(steps) > 0 {
+		results, err := runProvisioning(ctx, driverName, driver, hostName, steps)
+		result["provision"] = results
+		if err != nil {
+			return failed(err)
+		}
+		if engine != nil {
+			result["engine"] = engine
+		}
+		err = updateMachineRecord(ctx, driverName, hostName, func(record *machineRecord) {
+			record.Engine = engine
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.Cluster != "" {
+		if _, err := joinNewMachine(ctx, options.Cluster, machineRef{Driver: driverName, Name: hostName}); err != nil {
+			return failed(err)
+		}
+		result["cluster"] = &clusterRole{Name: options.Cluster, Role: clusterRoleAgent}
+	}
+	err := updateMachineRecord(ctx, driverName, hostName, func(record *machineRecord) {
+		record.Create.Result = result
+		record.Create.Failed = ""
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 func GetInstanceState(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
 	hostName, driver, err := loadDriver(ctx, resp, req)
 	if err != nil {
 		return
 	}
 
-	state, err := driver.GetState()
+	state, err := getState(ctx, driverName, driver, hostName)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+
+	lifecycle, err := getLifecycle(ctx, driverName, hostName)
 	if err != nil {
 		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	result := map[string]interface{}{
-		"name":  hostName,
-		"state": state.String(),
+		"name":      hostName,
+		"state":     state.String(),
+		"lifecycle": lifecycle,
 	}
 	server.Marshal(resp, req, result)
 }
 
 func PutInstanceState(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
-	hostName, driver, err := loadDriver(ctx, resp, req)
+	wait, err := getWaitOptions(req)
+	if err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	dryRun, err := getDryRun(req)
 	if err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
 	action := server.GetUrlParameter(req, "action")
+	result, err := changeState(ctx, driverName, hostName, action, wait, dryRun)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	server.Marshal(resp, req, result)
+}
+
+// Checks that the action is one that changes the power state of a machine.
+func checkAction(action string) error {
+	switch action {
+	case "start", "stop", "restart", "kill":
+		return nil
+	}
+	return newStatusError(http.StatusBadRequest, "err-unknown-action:"+action)
+}
+
+func changeState(ctx context.Context, driverName, hostName, action string, wait waitOptions, dryRun bool) (map[string]interface{}, error) {
+	if err := checkAction(action); err != nil {
+		return nil, err
+	}
+
+	unlock := lockMachine(driverName, hostName)
+	defer unlock()
+
+	if action == "kill" {
+		if err := checkUnprotected(ctx, driverName, hostName); err != nil {
+			return nil, err
+		}
+	}
+	lifecycle, err := checkTransition(ctx, driverName, hostName, action)
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := restoreDriver(ctx, driverName, hostName)
+	if err != nil {
+		return nil, err
+	}
+	secrets := redactedValues(ctx, driverName, storedRefs(ctx, driverName, hostName))
+	glog.Infoln("DRIVER=", driverToJSON(driver, secrets...))
+
+	if dryRun {
+		config := redactedConfig(driver)
+		redactValues(config, secrets)
+		return map[string]interface{}{
+			"name":      hostName,
+			"driver":    driverName,
+			"dry_run":   true,
+			"action":    action,
+			"lifecycle": lifecycle,
+			"next":      operationLifecycles[action][1],
+			"config":    config,
+		}, nil
+	}
+
 	switch action {
 	case "start":
-		err = driver.Start()
+		err = runOperation(ctx, driverName, driver, action, hostName, driver.Start)
 	case "stop":
-		err = driver.Stop()
+		err = runOperation(ctx, driverName, driver, action, hostName, driver.Stop)
 	case "restart":
-		err = driver.Restart()
+		err = runOperation(ctx, driverName, driver, action, hostName, driver.Restart)
 	case "kill":
-		err = driver.Kill()
-	default:
-		server.HandleError(ctx, http.StatusBadRequest, "err-unknown-action:"+action)
-		return
+		err = runOperation(ctx, driverName, driver, action, hostName, driver.Kill)
 	}
 	if err != nil {
-		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
-		return
+		return nil, err
 	}
 
-	err = saveDriver(ctx, driver, action, hostName)
+	err = saveDriver(ctx, driverName, driver, action, hostName)
 	if err != nil {
-		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
-		return
+		return nil, err
 	}
 
-	newState, err := driver.GetState()
-	if err != nil {
-		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
-		return
+	if wait.needed() {
+		if err := waitFor(ctx, driverName, driver, hostName, wait); err != nil {
+			return nil, newStatusError(statusOf(err), err.Error()+":"+hostName)
+		}
 	}
-	result := map[string]interface{}{
-		"name":  hostName,
-		"state": newState.String(),
+
+	newState, err := getState(ctx, driverName, driver, hostName)
+	if err != nil {
+		return nil, err
 	}
-	server.Marshal(resp, req, result)
+	return map[string]interface{}{
+		"name":      hostName,
+		"state":     newState.String(),
+		"lifecycle": operationLifecycles[action][1],
+	}, nil
 }
 
 func RemoveInstance(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
-	hostName, driver, err := loadDriver(ctx, resp, req)
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+	result, err := removeMachine(ctx, driverName, hostName)
 	if err != nil {
+		renderError(ctx, err)
 		return
 	}
+	server.Marshal(resp, req, result)
+}
+
+func removeMachine(ctx context.Context, driverName, hostName string) (map[string]interface{}, error) {
+	unlock := lockMachine(driverName, hostName)
+	defer unlock()
+
+	if err := checkUnprotected(ctx, driverName, hostName); err != nil {
+		return nil, err
+	}
+	if err := checkNotClusterMaster(ctx, driverName, hostName); err != nil {
+		return nil, err
+	}
+	if _, err := checkTransition(ctx, driverName, hostName, "remove"); err != nil {
+		return nil, err
+	}
 
-	err = driver.Remove()
+	driver, err := restoreDriver(ctx, driverName, hostName)
 	if err != nil {
-		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
-		return
+		return nil, err
 	}
+	glog.Infoln("DRIVER=", driverToJSON(driver, redactedValues(ctx, driverName, storedRefs(ctx, driverName, hostName))...))
 
-	err = saveDriver(ctx, driver, "remove", hostName)
+	err = runOperation(ctx, driverName, driver, "remove", hostName, driver.Remove)
 	if err != nil {
-		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
-		return
+		return nil, err
 	}
 
-	newState, err := driver.GetState()
+	err = saveDriver(ctx, driverName, driver, "remove", hostName)
 	if err != nil {
-		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
-		return
+		return nil, err
 	}
-	result := map[string]interface{}{
-		"name":  hostName,
-		"state": newState.String(),
+
+	var cluster *clusterRole
+	err = updateMachineRecord(ctx, driverName, hostName, func(record *machineRecord) {
+		now := time.Now()
+		record.Removed = &now
+		record.Create = nil
+		cluster = record.Cluster
+	})
+	if err != nil {
+		return nil, err
 	}
-	server.Marshal(resp, req, result)
+	if cluster != nil {
+		leaveRemovedMachine(ctx, cluster.Name, machineRef{Driver: driverName, Name: hostName})
+	}
+
+	newState, err := getState(ctx, driverName, driver, hostName)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"name":      hostName,
+		"state":     newState.String(),
+		"lifecycle": Removed,
+	}, nil
+}
+
+func getState(ctx context.Context, provider string, driver drivers.Driver, hostName string) (s state.State, err error) {
+	err = runOperation(ctx, provider, driver, "state", hostName, func() (err error) {
+		s, err = driver.GetState()
+		return
+	})
+	if err == nil {
+		setRecordState(ctx, provider, hostName, s)
+	}
+	return
 }
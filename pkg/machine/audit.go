@@ -0,0 +1,104 @@
+package machine
+
+import (
+	"encoding/json"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// Auth scope needed to read the audit log of a machine.
+	AuditScope = "machine-audit"
+)
+
+// An entry in the audit log of a machine: who did what to it through the server, beyond
+// the operations in the journal.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Identity string    `json:"identity,omitempty"`
+	Action   string    `json:"action"`
+	Detail   string    `json:"detail,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+}
+
+var (
+	auditLock sync.Mutex
+)
+
+// Appends the entry to the audit log of the machine.  The identity is taken from the auth
+// token of the request when not set.  Requests for machines that do not exist are only in
+// the server log, so that they leave no directory behind.
+func writeAudit(ctx context.Context, provider, hostName string, entry auditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.Identity == "" {
+		entry.Identity = callerIdentity(ctx)
+	}
+	glog.Infoln("Audit", provider, hostName, entry.Identity, entry.Action, entry.Detail, entry.Status)
+
+	dir := machineDir(ctx, provider, hostName)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return
+	}
+	buff, err := json.Marshal(entry)
+	if err == nil {
+		auditLock.Lock()
+		defer auditLock.Unlock()
+		var f *os.File
+		f, err = os.OpenFile(path.Join(dir, "audit.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = f.Write(append(buff, '\n'))
+			f.Close()
+		}
+	}
+	if err != nil {
+		glog.Warningln("Cannot audit", entry.Action, "of", hostName, "Err=", err)
+	}
+}
+
+func readAudit(ctx context.Context, provider, hostName string) ([]auditEntry, error) {
+	entries := []auditEntry{}
+	f, err := os.Open(path.Join(machineDir(ctx, provider, hostName), "audit.log"))
+	switch {
+	case os.IsNotExist(err):
+		return entries, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+	// A decoder rather than a scanner, which gives up on lines longer than its buffer, as
+	// those of long commands are.
+	decoder := json.NewDecoder(f)
+	for {
+		entry := auditEntry{}
+		switch err := decoder.Decode(&entry); err {
+		case nil:
+			entries = append(entries, entry)
+		case io.EOF:
+			return entries, nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+func GetAudit(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+	entries, err := readAudit(ctx, driverName, hostName)
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	server.Marshal(resp, req, entries)
+}
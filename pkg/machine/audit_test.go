@@ -0,0 +1,34 @@
+package machine
+
+import (
+	"golang.org/x/net/context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadAudit(t *testing.T) {
+	defer inTempStore(t)()
+
+	ctx := context.Background()
+	if err := os.MkdirAll(machineDir(ctx, "test", "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Longer than a line of bufio.Scanner can be.
+	long := strings.Repeat("x", 256*1024)
+	writeAudit(ctx, "test", "a", auditEntry{Action: "exec", Detail: "true"})
+	writeAudit(ctx, "test", "a", auditEntry{Action: "exec", Detail: long})
+	writeAudit(ctx, "test", "a", auditEntry{Action: "shell"})
+
+	entries, err := readAudit(ctx, "test", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[1].Detail != long || entries[2].Action != "shell" {
+		t.Errorf("got %d entries", len(entries))
+	}
+
+	if entries, err := readAudit(ctx, "test", "none"); err != nil || len(entries) != 0 {
+		t.Errorf("no log: got %v %v", entries, err)
+	}
+}
@@ -0,0 +1,453 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBulkParallelism = 4
+	MaxBulkCount           = 500
+
+	// Finished bulk operations kept for tracking.
+	maxFinishedBulkOperations = 100
+
+	// What to do when one of the machines fails: stop starting the rest, or carry on.
+	BulkModeStop     = "stop"
+	BulkModeContinue = "continue"
+
+	// Placeholder in the name template for the index of the machine.
+	bulkIndexPlaceholder = "{n}"
+
+	// Auth scope needed to start or cancel a bulk operation.
+	BulkScope = "machine-bulk"
+)
+
+// Status of a bulk operation and of each of its machines.
+const (
+	bulkPending   = "pending"
+	bulkRunning   = "running"
+	bulkSucceeded = "succeeded"
+	bulkFailed    = "failed"
+	bulkSkipped   = "skipped"
+	bulkCancelled = "cancelled"
+)
+
+var (
+	ErrBadTemplate      = errors.New("err-bad-template")
+	ErrBadCount         = errors.New("err-bad-count")
+	ErrBadParallelism   = errors.New("err-bad-parallelism")
+	ErrBadMode          = errors.New("err-bad-mode")
+	ErrBulkNotFound     = errors.New("err-bulk-not-found")
+	ErrNoMachineMatched = errors.New("err-no-machine-matched")
+
+	bulkOperations     = map[string]*bulkOperation{}
+	bulkOperationsLock sync.Mutex
+)
+
+// Outcome of a bulk operation for one machine.
+type bulkResult struct {
+	Driver string                 `json:"driver"`
+	Name   string                 `json:"name"`
+	Status string                 `json:"status"`
+	Code   int                    `json:"code,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+	Result map[string]interface{} `json:"result,omitempty"`
+}
+
+// The parent of the per-machine operations of a bulk request.  It is kept in memory after it
+// finishes so that the report can be fetched by id.
+type bulkOperation struct {
+	Id          string        `json:"id"`
+	Operation   string        `json:"operation"`
+	Selector    string        `json:"selector,omitempty"`
+	Mode        string        `json:"mode"`
+	Parallelism int           `json:"parallelism"`
+	Status      string        `json:"status"`
+	Started     time.Time     `json:"started"`
+	Finished    *time.Time    `json:"finished,omitempty"`
+	Results     []*bulkResult `json:"results"`
+
+	lock   sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Options of a bulk request shared by create and actions.
+type bulkOptions struct {
+	mode        string
+	parallelism int
+	async       bool
+}
+
+func getBulkOptions(req *http.Request) (bulkOptions, error) {
+	opts := bulkOptions{mode: BulkModeStop, parallelism: DefaultBulkParallelism}
+	if v := server.GetUrlParameter(req, "mode"); v != "" {
+		opts.mode = v
+	}
+	switch opts.mode {
+	case BulkModeStop, BulkModeContinue:
+	default:
+		return opts, newStatusError(http.StatusBadRequest, ErrBadMode.Error()+":"+opts.mode)
+	}
+	if v := server.GetUrlParameter(req, "parallelism"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, newStatusError(http.StatusBadRequest, ErrBadParallelism.Error()+":"+v)
+		}
+		opts.parallelism = n
+	}
+	if v := server.GetUrlParameter(req, "async"); v != "" {
+		async, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, newStatusError(http.StatusBadRequest, err.Error())
+		}
+		opts.async = async
+	}
+	return opts, nil
+}
+
+// Expands the name template into count names.  The template must have the {n} placeholder
+// unless only one machine is asked for.
+func expandNames(template string, start, count int) ([]string, error) {
+	if count < 1 || count > MaxBulkCount {
+		return nil, newStatusError(http.StatusBadRequest, ErrBadCount.Error()+":"+strconv.Itoa(count))
+	}
+	if template == "" || (count > 1 && !strings.Contains(template, bulkIndexPlaceholder)) {
+		return nil, newStatusError(http.StatusBadRequest, ErrBadTemplate.Error()+":"+template)
+	}
+	names := []string{}
+	for i := start; i < start+count; i++ {
+		names = append(names, strings.Replace(template, bulkIndexPlaceholder, strconv.Itoa(i), -1))
+	}
+	return names, nil
+}
+
+func newBulkOperation(ctx context.Context, op, selector string, targets []machineRef, opts bulkOptions) *bulkOperation {
+	b := &bulkOperation{
+		Id:          mcnutils.TruncateID(mcnutils.GenerateRandomID()),
+		Operation:   op,
+		Selector:    selector,
+		Mode:        opts.mode,
+		Parallelism: opts.parallelism,
+		Status:      bulkRunning,
+		Started:     time.Now(),
+		Results:     []*bulkResult{},
+		done:        make(chan struct{}),
+	}
+	b.ctx, b.cancel = context.WithCancel(ctx)
+	for _, target := range targets {
+		b.Results = append(b.Results, &bulkResult{Driver: target.Driver, Name: target.Name, Status: bulkPending})
+	}
+	registerBulkOperation(b)
+	return b
+}
+
+// Registers the bulk operation, dropping the oldest finished ones beyond the limit.
+func registerBulkOperation(b *bulkOperation) {
+	bulkOperationsLock.Lock()
+	defer bulkOperationsLock.Unlock()
+	bulkOperations[b.Id] = b
+
+	finished := []*bulkOperation{}
+	for _, o := range bulkOperations {
+		if o.finished() {
+			finished = append(finished, o)
+		}
+	}
+	if len(finished) <= maxFinishedBulkOperations {
+		return
+	}
+	sort.Sort(bulkOperationsByStart(finished))
+	for _, o := range finished[:len(finished)-maxFinishedBulkOperations] {
+		delete(bulkOperations, o.Id)
+	}
+}
+
+// Runs the call for each machine with at most Parallelism of them at a time.  In stop mode
+// no more machines are started after the first failure; those are reported as skipped.
+func (b *bulkOperation) run(call func(ctx context.Context, target machineRef) (map[string]interface{}, error)) {
+	defer b.finish()
+
+	slots := make(chan struct{}, b.Parallelism)
+	var wg sync.WaitGroup
+	for _, r := range b.Results {
+		slots <- struct{}{}
+		if b.stopping() {
+			<-slots
+			break
+		}
+		b.update(r, func() { r.Status = bulkRunning })
+		wg.Add(1)
+		go func(r *bulkResult) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result, err := call(b.ctx, machineRef{Driver: r.Driver, Name: r.Name})
+			b.update(r, func() {
+				if err != nil {
+					r.Status = bulkFailed
+					r.Code = statusOf(err)
+					r.Error = err.Error()
+					r.Result = result
+					return
+				}
+				r.Status = bulkSucceeded
+				r.Result = result
+			})
+		}(r)
+	}
+	wg.Wait()
+}
+
+func (b *bulkOperation) finished() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.Finished != nil
+}
+
+func (b *bulkOperation) stopping() bool {
+	if b.ctx.Err() != nil {
+		return true
+	}
+	if b.Mode != BulkModeStop {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, r := range b.Results {
+		if r.Status == bulkFailed {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *bulkOperation) update(r *bulkResult, change func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	change()
+}
+
+func (b *bulkOperation) finish() {
+	cancelled := b.ctx.Err() != nil
+	b.cancel()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.Status = bulkSucceeded
+	for _, r := range b.Results {
+		switch r.Status {
+		case bulkPending:
+			r.Status = bulkSkipped
+		case bulkFailed:
+			b.Status = bulkFailed
+		}
+	}
+	if cancelled {
+		b.Status = bulkCancelled
+	}
+	now := time.Now()
+	b.Finished = &now
+	close(b.done)
+}
+
+// Copy of the operation and its results that is safe to marshal while it runs.
+func (b *bulkOperation) snapshot() *bulkOperation {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s := &bulkOperation{
+		Id:          b.Id,
+		Operation:   b.Operation,
+		Selector:    b.Selector,
+		Mode:        b.Mode,
+		Parallelism: b.Parallelism,
+		Status:      b.Status,
+		Started:     b.Started,
+		Finished:    b.Finished,
+		Results:     []*bulkResult{},
+	}
+	for _, r := range b.Results {
+		result := *r
+		s.Results = append(s.Results, &result)
+	}
+	return s
+}
+
+// Runs the bulk operation and renders its report, or with async, renders the operation as
+// accepted and leaves it running.
+func respondBulk(ctx context.Context, resp http.ResponseWriter, req *http.Request, b *bulkOperation, async bool,
+	call func(ctx context.Context, target machineRef) (map[string]interface{}, error)) {
+	go b.run(call)
+	if async {
+		// Headers set after the status are not sent, so the content type goes first.
+		resp.Header().Set("Content-Type", server.ContentTypeForResponse(req))
+		resp.WriteHeader(http.StatusAccepted)
+	} else {
+		<-b.done
+	}
+	server.Marshal(resp, req, b.snapshot())
+}
+
+func BulkCreate(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	opts, err := getBulkOptions(req)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	wait, err := getWaitOptions(req)
+	if err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	dryRun, err := getDryRun(req)
+	if err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	count, start := 1, 1
+	if v := server.GetUrlParameter(req, "count"); v != "" {
+		if count, err = strconv.Atoi(v); err != nil {
+			server.HandleError(ctx, http.StatusBadRequest, ErrBadCount.Error()+":"+v)
+			return
+		}
+	}
+	if v := server.GetUrlParameter(req, "start"); v != "" {
+		if start, err = strconv.Atoi(v); err != nil {
+			server.HandleError(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	names, err := expandNames(server.GetUrlParameter(req, "name"), start, count)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if !isProvider(driverName) {
+		server.HandleError(ctx, http.StatusNotFound, "err-not-found:"+driverName)
+		return
+	}
+	payload, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	targets := []machineRef{}
+	for _, name := range names {
+		targets = append(targets, machineRef{Driver: driverName, Name: name})
+	}
+	// Each machine gets its own idempotency key derived from the one of the request, so that
+	// the whole bulk create can be repeated safely.
+	key := req.Header.Get(IdempotencyKeyHeader)
+	contentType := server.ContentTypeForRequest(req)
+
+	b := newBulkOperation(ctx, "create", "", targets, opts)
+	respondBulk(ctx, resp, req, b, opts.async, func(ctx context.Context, target machineRef) (map[string]interface{}, error) {
+		r := createRequest{
+			Driver:      target.Driver,
+			Name:        target.Name,
+			Payload:     payload,
+			ContentType: contentType,
+			Wait:        wait,
+			DryRun:      dryRun,
+		}
+		if key != "" {
+			r.IdempotencyKey = fmt.Sprintf("%s:%s", key, target.Name)
+		}
+		return createMachine(ctx, r)
+	})
+}
+
+func BulkAction(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	opts, err := getBulkOptions(req)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	wait, err := getWaitOptions(req)
+	if err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	dryRun, err := getDryRun(req)
+	if err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	action := server.GetUrlParameter(req, "action")
+	if err := checkAction(action); err != nil {
+		renderError(ctx, err)
+		return
+	}
+	selector, err := parseSelector(server.GetUrlParameter(req, "selector"))
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	targets := selectMachines(ctx, server.GetUrlParameter(req, "driver"), selector)
+	if len(targets) == 0 {
+		server.HandleError(ctx, http.StatusNotFound, ErrNoMachineMatched.Error()+":"+selector.String())
+		return
+	}
+
+	b := newBulkOperation(ctx, action, selector.String(), targets, opts)
+	respondBulk(ctx, resp, req, b, opts.async, func(ctx context.Context, target machineRef) (map[string]interface{}, error) {
+		return changeState(ctx, target.Driver, target.Name, action, wait, dryRun)
+	})
+}
+
+func ListBulkOperations(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	bulkOperationsLock.Lock()
+	list := []*bulkOperation{}
+	for _, b := range bulkOperations {
+		list = append(list, b.snapshot())
+	}
+	bulkOperationsLock.Unlock()
+
+	sort.Sort(bulkOperationsByStart(list))
+	server.Marshal(resp, req, list)
+}
+
+func getBulkOperation(ctx context.Context, req *http.Request) (*bulkOperation, bool) {
+	id := server.GetUrlParameter(req, "id")
+	bulkOperationsLock.Lock()
+	b, has := bulkOperations[id]
+	bulkOperationsLock.Unlock()
+	if !has {
+		server.HandleError(ctx, http.StatusNotFound, ErrBulkNotFound.Error()+":"+id)
+	}
+	return b, has
+}
+
+func GetBulkOperation(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	if b, has := getBulkOperation(ctx, req); has {
+		server.Marshal(resp, req, b.snapshot())
+	}
+}
+
+// Cancels the bulk operation.  Machines not yet started are skipped and the driver calls
+// in progress are abandoned as with CancelOperation.
+func CancelBulkOperation(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	if b, has := getBulkOperation(ctx, req); has {
+		b.cancel()
+		server.Marshal(resp, req, b.snapshot())
+	}
+}
+
+type bulkOperationsByStart []*bulkOperation
+
+func (l bulkOperationsByStart) Len() int           { return len(l) }
+func (l bulkOperationsByStart) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l bulkOperationsByStart) Less(i, j int) bool { return l[i].Started.Before(l[j].Started) }
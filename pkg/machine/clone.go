@@ -0,0 +1,180 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/conductant/gohm/pkg/encoding"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/docker/machine/libmachine/drivers"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	// Auth scope needed to clone a machine.
+	CloneScope = "machine-clone"
+)
+
+var (
+	ErrUnknownField      = errors.New("err-unknown-field")
+	ErrCloneNotSupported = errors.New("err-clone-not-supported")
+
+	// Fields of the stored driver configuration that belong to the instance rather than to
+	// its configuration: ids and addresses assigned by the provider, and keys generated for
+	// it.  Fields under "" are those of every driver.  The address is the configuration of
+	// the generic driver, as is the url of none.  Drivers that are not listed cannot be
+	// cloned, since what of their configuration is the instance's is not known.
+	instanceFields = map[string][]string{
+		"":                {"MachineName", "SSHKeyPath", "StorePath"},
+		"amazonec2":       {"IPAddress", "Id", "InstanceId", "PrivateIPAddress", "ReservationId", "SSHKeyID"},
+		"azure":           {"IPAddress"},
+		"digitalocean":    {"IPAddress", "DropletID", "DropletName", "SSHKeyID"},
+		"exoscale":        {"IPAddress", "Id", "PublicKey"},
+		"generic":         {},
+		"google":          {"IPAddress"},
+		"hyperv":          {"IPAddress"},
+		"none":            {},
+		"openstack":       {"IPAddress", "MachineId"},
+		"rackspace":       {"IPAddress", "MachineId"},
+		"softlayer":       {"IPAddress", "Id", "SSHKeyID"},
+		"virtualbox":      {"IPAddress"},
+		"vmwarefusion":    {"IPAddress"},
+		"vmwarevcloudair": {"IPAddress", "VAppID"},
+		"vmwarevsphere":   {"IPAddress"},
+	}
+)
+
+// The stored configuration of the driver without the fields of the instance, with the
+// overrides applied.  Overrides are fields of the configuration, as in the driver's log.
+func cloneConfig(driver drivers.Driver, overrides map[string]interface{}) (map[string]interface{}, error) {
+	config := map[string]interface{}{}
+	buff, err := json.Marshal(driver)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buff, &config); err != nil {
+		return nil, err
+	}
+
+	fields, listed := instanceFields[driver.DriverName()]
+	if !listed {
+		return nil, newStatusError(http.StatusBadRequest, ErrCloneNotSupported.Error()+":"+driver.DriverName())
+	}
+	for _, field := range append(instanceFields[""], fields...) {
+		delete(config, field)
+	}
+	// Key pairs made for the instance, as opposed to one given with the flags.
+	if driver.DriverName() == "amazonec2" && config["SSHPrivateKeyPath"] == "" {
+		delete(config, "KeyName")
+	}
+
+	unknown := []string{}
+	for k, v := range overrides {
+		if _, has := config[k]; !has {
+			unknown = append(unknown, k)
+			continue
+		}
+		config[k] = v
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, newStatusError(http.StatusBadRequest, ErrUnknownField.Error()+":"+strings.Join(unknown, ","))
+	}
+	return config, nil
+}
+
+// Configures the driver of a clone from the configuration.  The payload has the create
+// options.
+func applyConfig(driver drivers.Driver, config map[string]interface{}, payload []byte) (createOptions, error) {
+	options := createOptions{}
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &options); err != nil {
+			return options, newStatusError(http.StatusBadRequest, err.Error())
+		}
+	}
+	buff, err := json.Marshal(config)
+	if err != nil {
+		return options, err
+	}
+	if err := json.Unmarshal(buff, driver); err != nil {
+		return options, newStatusError(http.StatusBadRequest, err.Error())
+	}
+	return options, nil
+}
+
+// Creates a machine like an existing one.  The body may have kat-machine's create fields,
+// such as labels, and overrides of the driver configuration.  Labels are those of the
+// original unless given.
+func CloneInstance(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+
+	r := createRequest{
+		Driver:         driverName,
+		Name:           server.GetUrlParameter(req, "newName"),
+		IdempotencyKey: req.Header.Get(IdempotencyKeyHeader),
+		ContentType:    encoding.ContentTypeJSON.String(),
+		Source:         &machineRef{Driver: driverName, Name: hostName},
+	}
+	var err error
+	if r.Wait, err = getWaitOptions(req); err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.DryRun, err = getDryRun(req); err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	overrides := jsonFlags{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		contentType, err := encoding.ContentTypeFromString(server.ContentTypeForRequest(req))
+		if err != nil {
+			server.HandleError(ctx, http.StatusBadRequest, server.ErrBadContentType.Error())
+			return
+		}
+		if err := encoding.Unmarshal(contentType, bytes.NewReader(body), &overrides); err != nil {
+			server.HandleError(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	options, err := takeCreateOptions(overrides)
+	if err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	source, err := restoreDriver(ctx, driverName, hostName)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if r.Config, err = cloneConfig(source, overrides); err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if options.Labels == nil {
+		record, err := getMachineRecord(ctx, driverName, hostName)
+		if err != nil {
+			server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+			return
+		}
+		options.Labels = record.Labels
+	}
+	if r.Payload, err = json.Marshal(options); err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	result, err := createMachine(ctx, r)
+	renderCreate(ctx, resp, req, result, err)
+}
@@ -0,0 +1,61 @@
+package machine
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCloneConfig(t *testing.T) {
+	for _, c := range []struct {
+		driver  string
+		config  string
+		kept    []string
+		dropped []string
+	}{
+		{"generic", `{"IPAddress": "10.0.0.5", "SSHUser": "ubuntu", "SSHKey": "/keys/id_rsa", "MachineName": "a"}`,
+			[]string{"IPAddress", "SSHUser", "SSHKey"}, []string{"MachineName", "SSHKeyPath", "StorePath"}},
+		{"amazonec2", `{"IPAddress": "54.0.0.1", "InstanceId": "i-1", "Region": "us-east-1", "KeyName": "a"}`,
+			[]string{"Region"}, []string{"IPAddress", "InstanceId", "KeyName", "MachineName"}},
+		{"google", `{"IPAddress": "35.0.0.1", "Zone": "us-central1-a", "Address": "static"}`,
+			[]string{"Zone", "Address"}, []string{"IPAddress"}},
+		{"azure", `{"IPAddress": "40.0.0.1", "Location": "West US"}`,
+			[]string{"Location"}, []string{"IPAddress"}},
+	} {
+		_, driver := driverFactories[c.driver]("a", "/store")
+		if err := json.Unmarshal([]byte(c.config), driver); err != nil {
+			t.Fatal(err)
+		}
+		config, err := cloneConfig(driver, nil)
+		if err != nil {
+			t.Errorf("%s: %v", c.driver, err)
+			continue
+		}
+		for _, field := range c.kept {
+			if _, has := config[field]; !has {
+				t.Errorf("%s: %s dropped", c.driver, field)
+			}
+		}
+		for _, field := range c.dropped {
+			if _, has := config[field]; has {
+				t.Errorf("%s: %s kept", c.driver, field)
+			}
+		}
+	}
+
+	_, driver := driverFactories["generic"]("a", "/store")
+	if _, err := cloneConfig(driver, map[string]interface{}{"Foo": 1}); statusOf(err) != http.StatusBadRequest {
+		t.Errorf("unknown override: got %v", err)
+	}
+	config, err := cloneConfig(driver, map[string]interface{}{"IPAddress": "10.0.0.6"})
+	if err != nil || config["IPAddress"] != "10.0.0.6" {
+		t.Errorf("override: got %v %v", config, err)
+	}
+
+	fields := instanceFields["generic"]
+	delete(instanceFields, "generic")
+	defer func() { instanceFields["generic"] = fields }()
+	if _, err := cloneConfig(driver, nil); statusOf(err) != http.StatusBadRequest {
+		t.Errorf("driver not listed: got %v", err)
+	}
+}
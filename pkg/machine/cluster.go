@@ -0,0 +1,577 @@
+package machine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/conductant/kat-machine/pkg/provision"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Auth scope needed to create, change and remove clusters.
+	ClusterScope = "machine-cluster"
+
+	clusterRoleMaster = "master"
+	clusterRoleAgent  = "agent"
+)
+
+var (
+	ErrClusterNotFound = errors.New("err-cluster-not-found")
+	ErrClusterExists   = errors.New("err-cluster-exists")
+	ErrBadCluster      = errors.New("err-bad-cluster")
+	ErrInCluster       = errors.New("err-in-cluster")
+	ErrClusterMaster   = errors.New("err-cluster-master")
+	ErrNotMember       = errors.New("err-not-member")
+	ErrJoinFailed      = errors.New("err-cluster-join-failed")
+
+	clusterLocks     = map[string]*sync.Mutex{}
+	clusterLocksLock sync.Mutex
+)
+
+// A swarm cluster of machines in the inventory: a master running the swarm manager, and the
+// nodes it schedules containers on, the master among them.  Clusters are kept in the store,
+// one file each, and the record of each member names its cluster.
+type cluster struct {
+	Name    string                 `json:"name"`
+	Swarm   provision.SwarmOptions `json:"swarm"`
+	Master  machineRef             `json:"master"`
+	URL     string                 `json:"url,omitempty"`
+	Members []*clusterMember       `json:"members"`
+	Created time.Time              `json:"created"`
+}
+
+type clusterMember struct {
+	Driver string `json:"driver"`
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+
+	// The host:port of the engine of the node.
+	Address string    `json:"address"`
+	Joined  time.Time `json:"joined"`
+
+	// The steps run over ssh when the node joined.
+	Provision []provisionResult `json:"provision,omitempty"`
+}
+
+// The cluster a machine is in, kept in its record.
+type clusterRole struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// The payload that creates a cluster.  The members join as agents, after the master.
+type clusterRequest struct {
+	Master  machineRef              `json:"master"`
+	Members []machineRef            `json:"members,omitempty"`
+	Swarm   *provision.SwarmOptions `json:"swarm,omitempty"`
+}
+
+// A cluster with the members that could not join it.
+type clusterResult struct {
+	*cluster
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+func getClustersPath(ctx context.Context) string {
+	p := path.Join(getStoreRoot(ctx), "clusters")
+	err := os.MkdirAll(p, 0755)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Serializes changes to a cluster.  Returns the function that releases the lock.  Machine
+// locks may be held when taking it, but never taken while holding it.
+func lockCluster(name string) func() {
+	clusterLocksLock.Lock()
+	lock, has := clusterLocks[name]
+	if !has {
+		lock = &sync.Mutex{}
+		clusterLocks[name] = lock
+	}
+	clusterLocksLock.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+func checkClusterName(name string) error {
+	if name == "" || name != path.Base(name) || strings.HasPrefix(name, ".") {
+		return newStatusError(http.StatusBadRequest, ErrBadCluster.Error()+":"+name)
+	}
+	return nil
+}
+
+func getCluster(ctx context.Context, name string) (*cluster, error) {
+	buff, err := ioutil.ReadFile(path.Join(getClustersPath(ctx), path.Base(name)+".json"))
+	switch {
+	case os.IsNotExist(err):
+		return nil, newStatusError(http.StatusNotFound, ErrClusterNotFound.Error()+":"+name)
+	case err != nil:
+		return nil, err
+	}
+	c := &cluster{}
+	if err := json.Unmarshal(buff, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func saveCluster(ctx context.Context, c *cluster) error {
+	buff, err := json.MarshalIndent(c, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(getClustersPath(ctx), c.Name+".json"), buff, 0644)
+}
+
+func listClusters(ctx context.Context) ([]*cluster, error) {
+	list := []*cluster{}
+	files, err := ioutil.ReadDir(getClustersPath(ctx))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		c, err := getCluster(ctx, strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+func (c *cluster) member(ref machineRef) (int, *clusterMember) {
+	for i, m := range c.Members {
+		if m.Driver == ref.Driver && m.Name == ref.Name {
+			return i, m
+		}
+	}
+	return -1, nil
+}
+
+func (c *cluster) nodes() []string {
+	nodes := []string{}
+	for _, m := range c.Members {
+		nodes = append(nodes, m.Address)
+	}
+	return nodes
+}
+
+// The host:port of the engine of a machine that can join a cluster.  Only machines with an
+// engine installed by kat-machine can, since the manager reaches them with certificates
+// from the same CA.
+func clusterCandidate(ctx context.Context, c *cluster, ref machineRef) (string, error) {
+	if lifecycle, err := getLifecycle(ctx, ref.Driver, ref.Name); err != nil || lifecycle == LifecycleNone || lifecycle == Removed {
+		return "", newStatusError(http.StatusNotFound, "err-not-found:"+ref.Name)
+	}
+	record, err := getMachineRecord(ctx, ref.Driver, ref.Name)
+	if err != nil {
+		return "", err
+	}
+	if record.Cluster != nil && record.Cluster.Name != c.Name {
+		return "", newStatusError(http.StatusConflict, ErrInCluster.Error()+":"+record.Cluster.Name)
+	}
+	if record.Engine == nil {
+		return "", newStatusError(http.StatusConflict, ErrNoEngine.Error()+":"+ref.Name)
+	}
+	return strings.TrimPrefix(record.Engine.URL, "tcp://"), nil
+}
+
+// Runs the steps on the machine over ssh, stopping at the first that fails.
+func runClusterSteps(ctx context.Context, ref machineRef, steps []provisionStep) ([]provisionResult, error) {
+	driver, err := restoreDriver(ctx, ref.Driver, ref.Name)
+	if err != nil {
+		return nil, err
+	}
+	results := []provisionResult{}
+	for _, step := range steps {
+		result := runStep(driver, step)
+		results = append(results, result)
+		if result.Error != "" {
+			glog.Warningln("Cluster step", step.Name, "of", ref.Name, "failed. Err=", result.Error)
+			return results, newStatusError(http.StatusBadGateway, ErrJoinFailed.Error()+":"+ref.Name+":"+step.Name)
+		}
+	}
+	return results, nil
+}
+
+// The steps that give the master the certificate of the manager, bound to its IP and name.
+func managerCertSteps(ctx context.Context, c *cluster, ip string) ([]provisionStep, error) {
+	ca, err := getCA(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ca.IssuePeer([]string{ip, c.Master.Name, "localhost"})
+	if err != nil {
+		return nil, err
+	}
+	files := provision.SwarmCertFiles(ca.CertPEM, cert)
+	paths := []string{}
+	for p, _ := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	steps := []provisionStep{}
+	for _, p := range paths {
+		permissions := "0644"
+		if path.Base(p) == "key.pem" {
+			permissions = "0600"
+		}
+		steps = append(steps, provisionStep{
+			Name: "swarm:" + path.Base(p),
+			File: &provisionFile{Path: p, Content: string(files[p]), Permissions: permissions},
+			Sudo: true,
+		})
+	}
+	return steps, nil
+}
+
+// Restarts the manager with the nodes of the cluster, which it only learns this way when
+// discovery is static.
+func restartManager(ctx context.Context, c *cluster) ([]provisionResult, error) {
+	return runClusterSteps(ctx, c.Master, []provisionStep{
+		{Name: "swarm:manage", Script: c.Swarm.ManageCommand(c.nodes()), Sudo: true},
+	})
+}
+
+// Joins the machine to the cluster.  The master gets the manager; with a discovery backend
+// every node runs an agent, and with static discovery the manager is restarted instead.
+// The cluster is changed but not saved.
+func joinCluster(ctx context.Context, c *cluster, ref machineRef, role string) (*clusterMember, error) {
+	if _, m := c.member(ref); m != nil {
+		return m, nil
+	}
+	address, err := clusterCandidate(ctx, c, ref)
+	if err != nil {
+		return nil, err
+	}
+	member := &clusterMember{Driver: ref.Driver, Name: ref.Name, Role: role, Address: address}
+
+	steps := []provisionStep{}
+	if role == clusterRoleMaster {
+		host := address
+		if i := strings.LastIndex(host, ":"); i > 0 {
+			host = host[:i]
+		}
+		more, err := managerCertSteps(ctx, c, host)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(more, provisionStep{
+			Name:   "swarm:manage",
+			Script: c.Swarm.ManageCommand(append(c.nodes(), address)),
+			Sudo:   true,
+		})
+		c.URL = fmt.Sprintf("tcp://%s:%d", host, c.Swarm.Port)
+	}
+	if !c.Swarm.StaticDiscovery() {
+		steps = append(steps, provisionStep{Name: "swarm:join", Script: c.Swarm.JoinCommand(address), Sudo: true})
+	}
+	if len(steps) > 0 {
+		if member.Provision, err = runClusterSteps(ctx, ref, steps); err != nil {
+			return nil, err
+		}
+	}
+	member.Joined = time.Now()
+	c.Members = append(c.Members, member)
+	if role == clusterRoleAgent && c.Swarm.StaticDiscovery() {
+		results, err := restartManager(ctx, c)
+		member.Provision = append(member.Provision, results...)
+		if err != nil {
+			c.Members = c.Members[:len(c.Members)-1]
+			return nil, err
+		}
+	}
+
+	err = updateMachineRecord(ctx, ref.Driver, ref.Name, func(record *machineRecord) {
+		record.Cluster = &clusterRole{Name: c.Name, Role: role}
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeJournal(ctx, ref.Driver, ref.Name, journalEntry{Operation: "cluster-join"})
+	publishEvent(event{Type: "cluster-joined", Driver: ref.Driver, Name: ref.Name, Message: c.Name})
+	return member, nil
+}
+
+// Takes the machine out of the cluster.  Swarm is stopped on the machine unless it is gone,
+// in which case only the membership changes.  The cluster is changed but not saved.
+func leaveCluster(ctx context.Context, c *cluster, ref machineRef, reachable bool) error {
+	i, m := c.member(ref)
+	if m == nil {
+		return newStatusError(http.StatusNotFound, ErrNotMember.Error()+":"+ref.Name)
+	}
+	if reachable {
+		_, err := runClusterSteps(ctx, ref, []provisionStep{
+			{Name: "swarm:leave", Script: c.Swarm.LeaveCommand(m.Role == clusterRoleMaster), Sudo: true},
+		})
+		if err != nil {
+			// The node is out of the cluster either way; a stray agent only advertises an
+			// engine the manager no longer trusts it with.
+			glog.Warningln("Cannot stop swarm on", ref.Name, "Err=", err)
+		}
+	}
+	c.Members = append(c.Members[:i], c.Members[i+1:]...)
+	if m.Role != clusterRoleMaster && c.Swarm.StaticDiscovery() {
+		if _, err := restartManager(ctx, c); err != nil {
+			c.Members = append(c.Members[:i], append([]*clusterMember{m}, c.Members[i:]...)...)
+			return err
+		}
+	}
+
+	err := updateMachineRecord(ctx, ref.Driver, ref.Name, func(record *machineRecord) {
+		if record.Cluster != nil && record.Cluster.Name == c.Name {
+			record.Cluster = nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	writeJournal(ctx, ref.Driver, ref.Name, journalEntry{Operation: "cluster-leave"})
+	publishEvent(event{Type: "cluster-left", Driver: ref.Driver, Name: ref.Name, Message: c.Name})
+	return nil
+}
+
+// Joins a machine just created to the cluster named in its create payload.
+func joinNewMachine(ctx context.Context, name string, ref machineRef) (*clusterMember, error) {
+	unlock := lockCluster(name)
+	defer unlock()
+
+	c, err := getCluster(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	member, err := joinCluster(ctx, c, ref, clusterRoleAgent)
+	if err != nil {
+		return nil, err
+	}
+	return member, saveCluster(ctx, c)
+}
+
+// Takes a machine that was removed out of its cluster.
+func leaveRemovedMachine(ctx context.Context, name string, ref machineRef) {
+	unlock := lockCluster(name)
+	defer unlock()
+
+	c, err := getCluster(ctx, name)
+	if err == nil {
+		err = leaveCluster(ctx, c, ref, false)
+	}
+	if err == nil {
+		err = saveCluster(ctx, c)
+	}
+	if err != nil {
+		glog.Warningln("Cannot take", ref.Name, "out of cluster", name, "Err=", err)
+	}
+}
+
+// Checks that a machine about to be removed is not the master of a cluster.
+func checkNotClusterMaster(ctx context.Context, provider, hostName string) error {
+	record, err := getMachineRecord(ctx, provider, hostName)
+	if err != nil {
+		return err
+	}
+	if record.Cluster != nil && record.Cluster.Role == clusterRoleMaster {
+		return newStatusError(http.StatusConflict, ErrClusterMaster.Error()+":"+record.Cluster.Name)
+	}
+	return nil
+}
+
+// Creates a cluster with the master and members, which must have the engine installed.  The
+// cluster exists once the master runs the manager; members that cannot join are listed in
+// the errors of the result and can be added again later.
+func CreateCluster(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	name := server.GetUrlParameter(req, "cluster")
+	if err := checkClusterName(name); err != nil {
+		renderError(ctx, err)
+		return
+	}
+	r := &clusterRequest{}
+	if err := server.Unmarshal(resp, req, r); err != nil {
+		return
+	}
+	swarm := provision.SwarmOptions{}
+	if r.Swarm != nil {
+		swarm = *r.Swarm
+	}
+	if err := swarm.Normalize(); err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.Master.Driver == "" || r.Master.Name == "" {
+		server.HandleError(ctx, http.StatusBadRequest, ErrBadCluster.Error()+":no-master")
+		return
+	}
+
+	unlock := lockCluster(name)
+	defer unlock()
+
+	if _, err := getCluster(ctx, name); err == nil {
+		server.HandleError(ctx, http.StatusConflict, ErrClusterExists.Error()+":"+name)
+		return
+	}
+	c := &cluster{
+		Name:    name,
+		Swarm:   swarm,
+		Master:  r.Master,
+		Members: []*clusterMember{},
+		Created: time.Now(),
+	}
+	if _, err := joinCluster(ctx, c, r.Master, clusterRoleMaster); err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if err := saveCluster(ctx, c); err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	publishEvent(event{Type: "cluster-created", Driver: r.Master.Driver, Name: r.Master.Name, Message: name})
+
+	result := clusterResult{cluster: c}
+	for _, ref := range r.Members {
+		_, err := joinCluster(ctx, c, ref, clusterRoleAgent)
+		if err == nil {
+			err = saveCluster(ctx, c)
+		}
+		if err != nil {
+			if result.Errors == nil {
+				result.Errors = map[string]string{}
+			}
+			result.Errors[path.Join(ref.Driver, ref.Name)] = err.Error()
+		}
+	}
+	server.Marshal(resp, req, result)
+}
+
+func ListClusters(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	list, err := listClusters(ctx)
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	server.Marshal(resp, req, list)
+}
+
+func GetCluster(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	c, err := getCluster(ctx, server.GetUrlParameter(req, "cluster"))
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	server.Marshal(resp, req, c)
+}
+
+// Stops swarm on every member, the master last, and forgets the cluster.  Members that
+// cannot be reached are let go of all the same.
+func RemoveCluster(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	name := server.GetUrlParameter(req, "cluster")
+
+	unlock := lockCluster(name)
+	defer unlock()
+
+	c, err := getCluster(ctx, name)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	for i := len(c.Members) - 1; i >= 0; i-- {
+		m := c.Members[i]
+		ref := machineRef{Driver: m.Driver, Name: m.Name}
+		_, removed := getRemovedTime(ctx, m.Driver, m.Name)
+		if !removed {
+			_, err := runClusterSteps(ctx, ref, []provisionStep{
+				{Name: "swarm:leave", Script: c.Swarm.LeaveCommand(m.Role == clusterRoleMaster), Sudo: true},
+			})
+			if err != nil {
+				glog.Warningln("Cannot stop swarm on", m.Name, "Err=", err)
+			}
+		}
+		updateMachineRecord(ctx, m.Driver, m.Name, func(record *machineRecord) {
+			if record.Cluster != nil && record.Cluster.Name == name {
+				record.Cluster = nil
+			}
+		})
+		writeJournal(ctx, m.Driver, m.Name, journalEntry{Operation: "cluster-leave"})
+	}
+	if err := os.Remove(path.Join(getClustersPath(ctx), c.Name+".json")); err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	publishEvent(event{Type: "cluster-removed", Driver: c.Master.Driver, Name: c.Master.Name, Message: name})
+	server.Marshal(resp, req, c)
+}
+
+// Adds a machine to the cluster as an agent.  Adding a member again changes nothing.
+func AddClusterNode(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	name := server.GetUrlParameter(req, "cluster")
+	ref := machineRef{
+		Driver: server.GetUrlParameter(req, "driver"),
+		Name:   server.GetUrlParameter(req, "name"),
+	}
+
+	unlock := lockCluster(name)
+	defer unlock()
+
+	c, err := getCluster(ctx, name)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if _, err := joinCluster(ctx, c, ref, clusterRoleAgent); err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if err := saveCluster(ctx, c); err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	server.Marshal(resp, req, c)
+}
+
+// Takes an agent out of the cluster.  The master only leaves with the cluster.
+func RemoveClusterNode(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	name := server.GetUrlParameter(req, "cluster")
+	ref := machineRef{
+		Driver: server.GetUrlParameter(req, "driver"),
+		Name:   server.GetUrlParameter(req, "name"),
+	}
+
+	unlock := lockCluster(name)
+	defer unlock()
+
+	c, err := getCluster(ctx, name)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if _, m := c.member(ref); m != nil && m.Role == clusterRoleMaster {
+		server.HandleError(ctx, http.StatusConflict, ErrClusterMaster.Error()+":"+name)
+		return
+	}
+	_, removed := getRemovedTime(ctx, ref.Driver, ref.Name)
+	if err := leaveCluster(ctx, c, ref, !removed); err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if err := saveCluster(ctx, c); err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	server.Marshal(resp, req, c)
+}
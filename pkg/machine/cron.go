@@ -0,0 +1,164 @@
+package machine
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadCron = errors.New("err-bad-cron")
+
+	cronMonths = map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}
+	cronDays = map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}
+)
+
+// A standard five field cron expression: minute hour day-of-month month day-of-week.  Fields
+// take *, lists, ranges and steps, e.g. 0 19 * * Mon-Fri or */15 8-18 * * 1,3,5.  Months
+// and days of the week may be given by their three letter names; Sunday is 0 or 7.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+
+	// As in cron, when both days are restricted a day matches either of them.
+	domAny, dowAny bool
+}
+
+func parseCron(s string) (*cronSpec, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, errors.New(ErrBadCron.Error() + ":" + s)
+	}
+	c := &cronSpec{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, err
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// Parses a field into a bit set of the values it matches.
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	bad := errors.New(ErrBadCron.Error() + ":" + field)
+	value := func(s string) (int, error) {
+		if n, has := names[strings.ToLower(s)]; has {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, bad
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, term := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(term, "/"); i > -1 {
+			n, err := strconv.Atoi(term[i+1:])
+			if err != nil || n < 1 {
+				return 0, bad
+			}
+			step = n
+			term = term[:i]
+		}
+		lo, hi := min, max
+		switch {
+		case term == "*":
+		case strings.Contains(term, "-"):
+			ends := strings.SplitN(term, "-", 2)
+			var err error
+			if lo, err = value(ends[0]); err != nil {
+				return 0, err
+			}
+			if hi, err = value(ends[1]); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, bad
+			}
+		default:
+			n, err := value(term)
+			if err != nil {
+				return 0, err
+			}
+			lo = n
+			if step == 1 {
+				hi = n
+			}
+		}
+		for n := lo; n <= hi; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSpec) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// The first time after t that matches, in the location of t.  Zero if there is none within
+// five years, as with a day that does not exist like 30 Feb.  The time must also be later
+// on the wall clock, so that a time repeated as the clocks go back is run once; a time
+// skipped as they go forward is not run that day.
+func (c *cronSpec) next(t time.Time) time.Time {
+	after := wallClock(t)
+	t = t.Add(time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 || !wallClock(t).After(after) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// The time as read on the clock of its location.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
@@ -0,0 +1,128 @@
+package machine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, c := range []struct {
+		expr string
+		ok   bool
+	}{
+		{"0 19 * * Mon-Fri", true},
+		{"*/15 8-18 * * 1,3,5", true},
+		{"0 0 1 jan,Jul *", true},
+		{"0 0 * * 7", true},
+		{"5/20 * * * *", true},
+		{"0 19 * *", false},
+		{"0 19 * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"x * * * *", false},
+		{"* * * * Mon-", false},
+	} {
+		_, err := parseCron(c.expr)
+		if (err == nil) != c.ok {
+			t.Errorf("%q: got %v", c.expr, err)
+		}
+	}
+}
+
+func TestParseCronField(t *testing.T) {
+	for _, c := range []struct {
+		field string
+		min   int
+		max   int
+		bits  uint64
+	}{
+		{"*", 0, 6, 0x7f},
+		{"1,3,5", 0, 6, 1<<1 | 1<<3 | 1<<5},
+		{"mon-wed", 0, 7, 1<<1 | 1<<2 | 1<<3},
+		{"*/20", 0, 59, 1<<0 | 1<<20 | 1<<40},
+		{"10-20/5", 0, 59, 1<<10 | 1<<15 | 1<<20},
+		{"50/5", 0, 59, 1<<50 | 1<<55},
+	} {
+		bits, err := parseCronField(c.field, c.min, c.max, cronDays)
+		if err != nil {
+			t.Errorf("%q: %v", c.field, err)
+			continue
+		}
+		if bits != c.bits {
+			t.Errorf("%q: got %b, want %b", c.field, bits, c.bits)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	at := func(loc *time.Location, s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	for _, c := range []struct {
+		name string
+		expr string
+		from time.Time
+		next time.Time
+	}{
+		{"later the same hour", "*/15 * * * *",
+			at(time.UTC, "2026-10-19 10:07").Add(30 * time.Second), at(time.UTC, "2026-10-19 10:15")},
+		{"not the time it is at", "0 19 * * *",
+			at(time.UTC, "2026-10-19 19:00"), at(time.UTC, "2026-10-20 19:00")},
+		{"weekdays over the weekend", "0 19 * * Mon-Fri",
+			at(time.UTC, "2026-10-16 19:00"), at(time.UTC, "2026-10-19 19:00")},
+		{"sunday as 7", "0 8 * * 7",
+			at(time.UTC, "2026-10-19 00:00"), at(time.UTC, "2026-10-25 08:00")},
+		{"day of the month or of the week", "0 0 13 * Fri",
+			at(time.UTC, "2026-10-01 00:00"), at(time.UTC, "2026-10-02 00:00")},
+		{"end of the year", "0 0 1 1 *",
+			at(time.UTC, "2026-12-31 23:59"), at(time.UTC, "2027-01-01 00:00")},
+		{"31st in the months that have one", "0 0 31 * *",
+			at(time.UTC, "2026-04-01 00:00"), at(time.UTC, "2026-05-31 00:00")},
+		{"30th skips february", "0 6 30 * *",
+			at(time.UTC, "2026-01-30 06:00"), at(time.UTC, "2026-03-30 06:00")},
+		{"29 february of the next leap year", "0 12 29 2 *",
+			at(time.UTC, "2026-03-01 00:00"), at(time.UTC, "2028-02-29 12:00")},
+		{"a day that does not exist", "0 0 30 2 *",
+			at(time.UTC, "2026-03-01 00:00"), time.Time{}},
+		{"clocks going forward skip the time that day", "30 2 * * *",
+			at(la, "2026-03-08 00:00"), at(la, "2026-03-09 02:30")},
+		{"clocks going forward past the hour", "0 3 * * *",
+			at(la, "2026-03-08 00:00"), at(la, "2026-03-08 03:00")},
+		{"clocks going back run the time once", "30 1 * * *",
+			at(la, "2026-11-01 01:30"), at(la, "2026-11-02 01:30")},
+		{"a day of 25 hours", "0 9 * * *",
+			at(la, "2026-10-31 09:00"), at(la, "2026-11-01 09:00")},
+	} {
+		spec, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next := spec.next(c.from); !next.Equal(c.next) {
+			t.Errorf("%s: got %v, want %v", c.name, next, c.next)
+		}
+	}
+
+	// The first of the two 01:30 as the clocks go back is the one in daylight time.
+	spec, _ := parseCron("30 1 * * *")
+	next := spec.next(at(la, "2026-11-01 00:00"))
+	if _, offset := next.Zone(); offset != -7*60*60 {
+		t.Errorf("clocks going back: got %v", next)
+	}
+	if d := spec.next(next).Sub(next); d != 25*time.Hour {
+		t.Errorf("clocks going back: got the next run %v later", d)
+	}
+}
@@ -0,0 +1,200 @@
+package machine
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/conductant/kat-machine/pkg/provision"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// Auth scope needed to call the Docker API of machines through the server.
+	DockerProxyScope = "docker-proxy"
+
+	// The identity of the client certificate the server itself uses with the engines.
+	proxyIdentity = "kat-machine"
+
+	proxyFlushInterval = 100 * time.Millisecond
+)
+
+var (
+	ErrNoEngine      = errors.New("err-no-engine")
+	ErrNotHijackable = errors.New("err-not-hijackable")
+
+	proxyTransport       *http.Transport
+	proxyTransportSerial string
+	proxyTransportLock   sync.Mutex
+)
+
+// Loads the client certificate the server uses with the engines, issuing it the first time.
+// It is kept with the CA.
+func getProxyCert(ctx context.Context, ca *provision.CA) (tls.Certificate, error) {
+	certPath := path.Join(getCAPath(ctx), "proxy.pem")
+	keyPath := path.Join(getCAPath(ctx), "proxy-key.pem")
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		cert, err := ca.IssueClient(proxyIdentity, provision.CertValidity)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := ioutil.WriteFile(keyPath, cert.Key, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := ioutil.WriteFile(certPath, cert.Cert, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+// The transport to the engines, which trusts only the CA of the server and presents the
+// client certificate of the server.  It is kept for as long as the CA and the certificate in
+// the store are the same, by serial.
+func getProxyTransport(ctx context.Context) (*http.Transport, error) {
+	proxyTransportLock.Lock()
+	defer proxyTransportLock.Unlock()
+
+	ca, err := getCA(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := getProxyCert(ctx, ca)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	serial := ca.Cert.SerialNumber.String() + "/" + leaf.SerialNumber.String()
+	if proxyTransport != nil && proxyTransportSerial == serial {
+		return proxyTransport, nil
+	}
+	if proxyTransport != nil {
+		proxyTransport.CloseIdleConnections()
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	proxyTransportSerial = serial
+	proxyTransport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+	return proxyTransport, nil
+}
+
+// The url of the Docker API of the machine, from the engine installed at create or else the
+// driver.
+func getEngineURL(ctx context.Context, provider, hostName string) (*url.URL, error) {
+	driver, err := restoreDriver(ctx, provider, hostName)
+	if err != nil {
+		return nil, err
+	}
+	record, err := getMachineRecord(ctx, provider, hostName)
+	if err != nil {
+		return nil, err
+	}
+	engine, err := engineURL(driver, record)
+	if err != nil {
+		return nil, newStatusError(http.StatusBadGateway, ErrNoEngine.Error()+":"+hostName)
+	}
+	u, err := url.Parse(engine)
+	if err != nil {
+		return nil, newStatusError(http.StatusBadGateway, ErrNoEngine.Error()+":"+hostName)
+	}
+	return &url.URL{Scheme: "https", Host: u.Host}, nil
+}
+
+// Forwards calls to the Docker API of the machine with the client certificate of the server.
+// Like the reverse proxy of gohm, but that one cannot be given a transport.  Every call is
+// written to the audit log of the machine.
+func ProxyDocker(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+
+	target, err := getEngineURL(ctx, driverName, hostName)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	transport, err := getProxyTransport(ctx)
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	p := "/" + server.GetUrlParameter(req, "path")
+	proxy := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme = target.Scheme
+			out.URL.Host = target.Host
+			out.URL.Path = p
+			out.URL.RawPath = ""
+			out.Host = target.Host
+			// The token is for the server, not the engine.
+			out.Header.Del("Authorization")
+		},
+		Transport:     transport,
+		FlushInterval: proxyFlushInterval,
+	}
+
+	started := time.Now()
+	recorder := &statusRecorder{ResponseWriter: resp, status: http.StatusOK}
+	proxy.ServeHTTP(recorder, req)
+
+	detail := req.Method + " " + p
+	if req.URL.RawQuery != "" {
+		detail += "?" + req.URL.RawQuery
+	}
+	writeAudit(ctx, driverName, hostName, auditEntry{
+		Action:   "docker",
+		Detail:   detail,
+		Status:   recorder.status,
+		Duration: time.Since(started).String(),
+	})
+}
+
+// Remembers the status of the response.  Streaming and the upgraded connections of attach
+// need the flusher and hijacker of the writer underneath.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := r.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, ErrNotHijackable
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/conductant/gohm/pkg/server"
 	"github.com/docker/machine/libmachine/drivers"
+	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"io/ioutil"
 	"net/http"
@@ -93,6 +94,12 @@ func getMachinePath(ctx context.Context, provider, hostName string) string {
 	return machinePath
 }
 
+// Path of the machine directory without creating it, for reads that should leave no trace
+// of a machine that does not exist.
+func machineDir(ctx context.Context, provider, hostName string) string {
+	return path.Join(getStoreRoot(ctx), provider, "machines", hostName)
+}
+
 func getMachineLogPath(ctx context.Context, provider, hostName string) string {
 	logPath := path.Join(getMachinePath(ctx, provider, hostName), "log")
 	err := os.MkdirAll(logPath, 0755)
@@ -102,15 +109,144 @@ func getMachineLogPath(ctx context.Context, provider, hostName string) string {
 	return logPath
 }
 
-func saveDriver(ctx context.Context, driver drivers.Driver, operation, hostName string) error {
-	state, err := json.Marshal(driver)
+// Values of the driver configuration that are not written to disk, with the reference each
+// is stored as instead, such as {"credential": "digitalocean-access-token"} for a credential
+// of the account or {"secret": "do-team-a"} for a secret.  They are by value since the
+// fields of a driver are not named after its flags.
+type credentialRefs map[string]interface{}
+
+func (refs credentialRefs) add(more credentialRefs) {
+	for value, ref := range more {
+		if value != "" {
+			refs[value] = ref
+		}
+	}
+}
+
+func (refs credentialRefs) values() []string {
+	values := []string{}
+	for value := range refs {
+		values = append(values, value)
+	}
+	return values
+}
+
+// Replaces the values in the configuration with their references.
+func (refs credentialRefs) seal(config map[string]interface{}) {
+	for k, v := range config {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			refs.seal(v)
+		case string:
+			if ref, has := refs[v]; has && v != "" {
+				config[k] = ref
+			}
+		}
+	}
+}
+
+// The value of a stored reference, and whether it is one.  Secrets are opened as trusted for
+// the machine they are stored for, which was created by a request that could open them.
+func resolveRef(ctx context.Context, provider string, v interface{}, trusted bool) (string, bool, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return "", false, nil
+	}
+	if flag, ok := m["credential"].(string); ok {
+		account, _ := resolveAccount(provider)
+		value, err := account.credential(ctx, flag)
+		return value, true, err
+	}
+	if name, ok := secretRef(v); ok {
+		value, err := openSecret(ctx, name, trusted)
+		return value, true, err
+	}
+	return "", false, nil
+}
+
+// Replaces the references in the configuration with their values, and returns them.  A value
+// that cannot be had is left empty, and the first such error returned.
+func resolveRefs(ctx context.Context, provider string, config map[string]interface{}, trusted bool) (credentialRefs, error) {
+	refs := credentialRefs{}
+	var failed error
+	for k, v := range config {
+		value, isRef, err := resolveRef(ctx, provider, v, trusted)
+		switch {
+		case isRef && err != nil:
+			config[k] = ""
+			if failed == nil {
+				failed = err
+			}
+		case isRef:
+			config[k] = value
+			refs[value] = v
+		default:
+			if nested, ok := v.(map[string]interface{}); ok {
+				more, err := resolveRefs(ctx, provider, nested, trusted)
+				refs.add(more)
+				if failed == nil {
+					failed = err
+				}
+			}
+		}
+	}
+	return refs, failed
+}
+
+// The references in the last snapshot of the driver, by value.
+func storedRefs(ctx context.Context, provider, hostName string) credentialRefs {
+	config := map[string]interface{}{}
+	if lastState, err := getLastState(ctx, provider, hostName); err == nil && len(lastState) > 0 {
+		json.Unmarshal(lastState, &config)
+	}
+	refs, _ := resolveRefs(ctx, provider, config, true)
+	return refs
+}
+
+// The references in the last snapshot of the original of a clone, by value.  The clone is a
+// new machine, so the request must have the scopes of the secrets as it would to create it.
+func cloneRefs(ctx context.Context, provider, hostName string) (credentialRefs, error) {
+	config := map[string]interface{}{}
+	if lastState, err := getLastState(ctx, provider, hostName); err == nil && len(lastState) > 0 {
+		json.Unmarshal(lastState, &config)
+	}
+	return resolveRefs(ctx, provider, config, false)
+}
+
+type refsKey struct{}
+
+// The context with the references of the secrets the driver was configured with, for the
+// snapshots taken during the operation.
+func withRefs(ctx context.Context, refs credentialRefs) context.Context {
+	return context.WithValue(ctx, refsKey{}, refs)
+}
+
+// Saves a snapshot of the driver with its credentials and secrets as references: those of the
+// last snapshot, those of the context and those of the account.
+func saveDriver(ctx context.Context, provider string, driver drivers.Driver, operation, hostName string) error {
+	config := map[string]interface{}{}
+	buff, err := json.Marshal(driver)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(buff, &config); err != nil {
+		return err
+	}
+	all := storedRefs(ctx, provider, hostName)
+	if refs, ok := ctx.Value(refsKey{}).(credentialRefs); ok {
+		all.add(refs)
+	}
+	account, _ := resolveAccount(provider)
+	all.add(account.credentialRefs(ctx))
+	all.seal(config)
+	state, err := json.Marshal(config)
 	if err != nil {
 		return err
 	}
 
-	p := path.Join(getMachineLogPath(ctx, driver.DriverName(), hostName),
+	p := path.Join(getMachineLogPath(ctx, provider, hostName),
 		fmt.Sprintf("%d-%s.json", time.Now().Unix(), operation))
-	err = ioutil.WriteFile(p, state, 0644)
+	err = ioutil.WriteFile(p, state, 0600)
 	if err != nil {
 		return err
 	}
@@ -118,9 +254,12 @@ func saveDriver(ctx context.Context, driver drivers.Driver, operation, hostName
 }
 
 func getLastState(ctx context.Context, provider, hostName string) ([]byte, error) {
-	logs := getMachineLogPath(ctx, provider, hostName)
+	logs := path.Join(machineDir(ctx, provider, hostName), "log")
 	list, err := ioutil.ReadDir(logs)
-	if err != nil {
+	switch {
+	case os.IsNotExist(err):
+		return []byte{}, nil
+	case err != nil:
 		return nil, err
 	}
 	if len(list) > 0 {
@@ -131,7 +270,11 @@ func getLastState(ctx context.Context, provider, hostName string) ([]byte, error
 }
 
 func getDriver(ctx context.Context, provider, hostName string) (driver drivers.Driver, restored bool, err error) {
-	factory, ok := driverFactories[provider]
+	account, ok := resolveAccount(provider)
+	if !ok {
+		return nil, false, ErrDriverNotFound
+	}
+	factory, ok := driverFactories[account.Driver]
 	if !ok {
 		return nil, false, ErrDriverNotFound
 	} else {
@@ -142,6 +285,9 @@ func getDriver(ctx context.Context, provider, hostName string) (driver drivers.D
 			return nil, false, err
 		}
 		if len(lastState) > 0 {
+			if lastState, err = restoreRefs(ctx, provider, hostName, lastState); err != nil {
+				return nil, false, err
+			}
 			if err := json.Unmarshal(lastState, driver); err == nil {
 				restored = true
 			}
@@ -150,8 +296,31 @@ func getDriver(ctx context.Context, provider, hostName string) (driver drivers.D
 	return
 }
 
-func driverToJSON(driver drivers.Driver) string {
-	buff, _ := json.MarshalIndent(driver, " ", " ")
+// The snapshot of the driver with the references resolved to their values.
+func restoreRefs(ctx context.Context, provider, hostName string, snapshot []byte) ([]byte, error) {
+	config := map[string]interface{}{}
+	if err := json.Unmarshal(snapshot, &config); err != nil {
+		// Not a configuration, which the driver will not restore from either.
+		return snapshot, nil
+	}
+	if _, err := resolveRefs(ctx, provider, config, true); err != nil {
+		glog.Warningln("Cannot resolve the credentials of", hostName, "Err=", err)
+	}
+	return json.Marshal(config)
+}
+
+// The values to redact from the driver configuration of a machine of the provider: the
+// secrets it was configured with and the credentials of the account.
+func redactedValues(ctx context.Context, provider string, secrets credentialRefs) []string {
+	account, _ := resolveAccount(provider)
+	return append(secrets.values(), account.credentialRefs(ctx).values()...)
+}
+
+// For logging.  Secrets in the driver configuration are redacted, as are the given values.
+func driverToJSON(driver drivers.Driver, secrets ...string) string {
+	config := redactedConfig(driver)
+	redactValues(config, secrets)
+	buff, _ := json.MarshalIndent(config, " ", " ")
 	return string(buff)
 }
 
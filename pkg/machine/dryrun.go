@@ -0,0 +1,84 @@
+package machine
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/docker/machine/libmachine/drivers"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	redacted = "<redacted>"
+)
+
+var (
+	ErrUnknownFlag = errors.New("err-unknown-flag")
+
+	// Fields of the driver configuration whose names contain any of these are secrets.
+	secretFieldHints = []string{"secret", "password", "passwd", "token", "accesskey", "apikey", "privatekey", "credential"}
+)
+
+func getDryRun(req *http.Request) (bool, error) {
+	if v := server.GetUrlParameter(req, "dry_run"); v != "" {
+		return strconv.ParseBool(v)
+	}
+	return false, nil
+}
+
+// Checks that every field of the input is a create flag of the driver.
+func validateInput(driver drivers.Driver, input jsonFlags) error {
+	known := map[string]bool{}
+	for _, flag := range driver.GetCreateFlags() {
+		known[flag.String()] = true
+	}
+	unknown := []string{}
+	for key, _ := range input {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return errors.New(ErrUnknownFlag.Error() + ":" + strings.Join(unknown, ","))
+	}
+	return nil
+}
+
+func isSecretField(name string) bool {
+	name = strings.ToLower(strings.Replace(strings.Replace(name, "_", "", -1), "-", "", -1))
+	for _, hint := range secretFieldHints {
+		if strings.Contains(name, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// The configuration of the driver as it would be stored, with the secrets redacted.
+func redactedConfig(driver drivers.Driver) map[string]interface{} {
+	config := map[string]interface{}{}
+	buff, err := json.Marshal(driver)
+	if err != nil {
+		return config
+	}
+	json.Unmarshal(buff, &config)
+	redact(config)
+	return config
+}
+
+func redact(config map[string]interface{}) {
+	for k, v := range config {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			redact(v)
+		case string:
+			if v != "" && isSecretField(k) {
+				config[k] = redacted
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package machine
+
+import (
+	"fmt"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/conductant/kat-machine/pkg/provision"
+	"github.com/docker/machine/libmachine/drivers"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// The engine installed on a machine and the certificate it was given.  The certificate and
+// its key are kept in the certs directory of the machine.
+type engineRecord struct {
+	URL         string    `json:"url"`
+	Hosts       []string  `json:"hosts"`
+	Fingerprint string    `json:"fingerprint"`
+	Issued      time.Time `json:"issued"`
+}
+
+// The url of the Docker API of the machine: that of the engine installed at create, which
+// knows its port, or else the driver's.
+func engineURL(driver drivers.Driver, record *machineRecord) (string, error) {
+	if record.Engine != nil {
+		return record.Engine.URL, nil
+	}
+	url, err := driver.GetURL()
+	if err == nil && url == "" {
+		err = ErrNoEngine
+	}
+	return url, err
+}
+
+func getCAPath(ctx context.Context) string {
+	return path.Join(getStoreRoot(ctx), "ca")
+}
+
+func getCA(ctx context.Context) (*provision.CA, error) {
+	return provision.LoadOrCreateCA(getCAPath(ctx))
+}
+
+func getMachineCertsPath(ctx context.Context, provider, hostName string) string {
+	certsPath := path.Join(getMachinePath(ctx, provider, hostName), "certs")
+	err := os.MkdirAll(certsPath, 0700)
+	if err != nil {
+		panic(err)
+	}
+	return certsPath
+}
+
+// Issues the certificate of the engine, bound to the IP of the machine, and returns the
+// steps that install and configure the engine with it.
+func engineSteps(ctx context.Context, provider string, driver drivers.Driver, hostName string,
+	opts provision.EngineOptions) ([]provisionStep, *engineRecord, error) {
+
+	ip, err := driver.GetIP()
+	if err != nil || ip == "" {
+		return nil, nil, newStatusError(http.StatusBadGateway, "err-no-ip:"+hostName)
+	}
+	ca, err := getCA(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	hosts := []string{ip, hostName, "localhost"}
+	cert, err := ca.IssueServer(hosts)
+	if err != nil {
+		return nil, nil, err
+	}
+	fingerprint, err := provision.Fingerprint(cert.Cert)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certsPath := getMachineCertsPath(ctx, provider, hostName)
+	files := map[string][]byte{"ca.pem": ca.CertPEM, "server.pem": cert.Cert, "server-key.pem": cert.Key}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(certsPath, name), content, 0600); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	steps := []provisionStep{
+		{Name: "engine:install", Script: opts.InstallCommand(), Sudo: true},
+	}
+	certFiles := provision.EngineCertFiles(ca.CertPEM, cert)
+	paths := []string{}
+	for p := range certFiles {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		content := certFiles[p]
+		permissions := "0644"
+		if path.Base(p) == "server-key.pem" {
+			permissions = "0600"
+		}
+		steps = append(steps, provisionStep{
+			Name: "engine:" + path.Base(p),
+			File: &provisionFile{Path: p, Content: string(content), Permissions: permissions},
+			Sudo: true,
+		})
+	}
+	steps = append(steps, provisionStep{Name: "engine:configure", Script: opts.ConfigureCommand(), Sudo: true})
+
+	record := &engineRecord{
+		URL:         fmt.Sprintf("tcp://%s:%d", ip, opts.Port),
+		Hosts:       hosts,
+		Fingerprint: fingerprint,
+		Issued:      time.Now(),
+	}
+	return steps, record, nil
+}
+
+// Gets the certificate of the CA that signs the engine certificates, for clients to verify
+// the engines with.
+func GetCACert(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	ca, err := getCA(ctx)
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp.Header().Set("Content-Type", "application/x-pem-file")
+	resp.Write(ca.CertPEM)
+}
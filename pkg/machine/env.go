@@ -0,0 +1,244 @@
+package machine
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/conductant/kat-machine/pkg/provision"
+	"golang.org/x/net/context"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// Auth scope needed to be issued a client certificate for the engines.
+	DockerClientScope = "docker-client"
+
+	// The claim of the auth token that names the caller.
+	IdentityClaim = "sub"
+
+	// Where the certificates are unpacked unless the caller says otherwise.
+	homeCertPath = "$HOME/.docker/kat-machine"
+
+	// How long the client certificates of certs.zip are valid.  They cannot be revoked, and
+	// are good for every engine of the CA, so they are kept short.
+	DefaultClientCertTTL = 24 * time.Hour
+)
+
+var (
+	ErrNoIdentity  = errors.New("err-no-identity")
+	ErrBadShell    = errors.New("err-bad-shell")
+	ErrBadCertPath = errors.New("err-bad-cert-path")
+
+	clientCertTTL     = DefaultClientCertTTL
+	clientCertTTLLock sync.Mutex
+)
+
+// A client certificate issued for the machine, by serial number, so that its use can be
+// traced back to the caller it was issued to.
+type clientCertRecord struct {
+	Serial  string    `json:"serial"`
+	Subject string    `json:"subject"`
+	Issued  time.Time `json:"issued"`
+	Expires time.Time `json:"expires"`
+}
+
+// Sets how long client certificates are valid.  Zero is DefaultClientCertTTL.
+func SetClientCertTTL(ttl time.Duration) {
+	clientCertTTLLock.Lock()
+	defer clientCertTTLLock.Unlock()
+	if ttl <= 0 {
+		ttl = DefaultClientCertTTL
+	}
+	clientCertTTL = ttl
+}
+
+func getClientCertTTL() time.Duration {
+	clientCertTTLLock.Lock()
+	defer clientCertTTLLock.Unlock()
+	return clientCertTTL
+}
+
+// The name of the caller from the auth token, or "" if the token does not say.
+func callerIdentity(ctx context.Context) string {
+	if v, ok := ctx.Value(IdentityClaim).(string); ok {
+		return v
+	}
+	return ""
+}
+
+// The environment for the docker client, as docker-machine env gives it.  The certificates
+// are those of certs.zip, unpacked in the cert path.
+func getDockerEnv(ctx context.Context, provider, hostName, certPath string) (map[string]string, error) {
+	driver, err := restoreDriver(ctx, provider, hostName)
+	if err != nil {
+		return nil, err
+	}
+	record, err := getMachineRecord(ctx, provider, hostName)
+	if err != nil {
+		return nil, err
+	}
+	url, err := engineURL(driver, record)
+	if err != nil {
+		return nil, newStatusError(http.StatusBadGateway, "err-no-url:"+hostName)
+	}
+	switch {
+	case certPath == "":
+		certPath = path.Join(homeCertPath, provider, hostName)
+	case !path.IsAbs(certPath) || strings.IndexFunc(certPath, unicode.IsControl) > -1:
+		return nil, newStatusError(http.StatusBadRequest, ErrBadCertPath.Error()+":"+certPath)
+	}
+	return map[string]string{
+		"DOCKER_TLS_VERIFY":   "1",
+		"DOCKER_HOST":         url,
+		"DOCKER_CERT_PATH":    certPath,
+		"DOCKER_MACHINE_NAME": hostName,
+	}, nil
+}
+
+// The value quoted for the shell.  Only the $HOME of the default cert path is expanded, which
+// both sh and fish do within double quotes.
+func shellValue(v string) string {
+	if strings.HasPrefix(v, homeCertPath+"/") {
+		return `"$HOME"` + shellQuote(strings.TrimPrefix(v, "$HOME"))
+	}
+	return shellQuote(v)
+}
+
+// Gets the docker client environment of the machine.  ?shell= is bash, the default, fish or
+// json, and ?cert_path= where certs.zip was unpacked.
+func GetDockerEnv(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+	shell := server.GetUrlParameter(req, "shell")
+
+	env, err := getDockerEnv(ctx, driverName, hostName, server.GetUrlParameter(req, "cert_path"))
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+
+	keys := []string{}
+	for k, _ := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buff := &bytes.Buffer{}
+	switch shell {
+	case "json":
+		server.Marshal(resp, req, env)
+		return
+	case "", "bash", "sh", "zsh":
+		for _, k := range keys {
+			fmt.Fprintf(buff, "export %s=%s\n", k, shellValue(env[k]))
+		}
+	case "fish":
+		for _, k := range keys {
+			fmt.Fprintf(buff, "set -gx %s %s;\n", k, shellValue(env[k]))
+		}
+	default:
+		server.HandleError(ctx, http.StatusBadRequest, ErrBadShell.Error()+":"+shell)
+		return
+	}
+	fmt.Fprintf(buff, "# Unpack certs.zip of the machine in %s\n", env["DOCKER_CERT_PATH"])
+	resp.Header().Set("Content-Type", "text/plain")
+	resp.Write(buff.Bytes())
+}
+
+// Gets a zip of a short lived client certificate for the caller, named by the auth token,
+// with the CA of the engines.  The files are named as the docker client expects them in its
+// cert path.  The serial of the certificate is kept in the record of the machine.
+func GetClientCerts(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+
+	identity := callerIdentity(ctx)
+	if identity == "" {
+		server.HandleError(ctx, http.StatusForbidden, ErrNoIdentity.Error())
+		return
+	}
+	if _, err := restoreDriver(ctx, driverName, hostName); err != nil {
+		renderError(ctx, err)
+		return
+	}
+	ca, err := getCA(ctx)
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ttl := getClientCertTTL()
+	cert, err := ca.IssueClient(identity, ttl)
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	serial, err := provision.SerialNumber(cert.Cert)
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	now := time.Now()
+	err = updateMachineRecord(ctx, driverName, hostName, func(record *machineRecord) {
+		// Only those that are still valid are of interest.
+		certs := []clientCertRecord{}
+		for _, c := range record.ClientCerts {
+			if c.Expires.After(now) {
+				certs = append(certs, c)
+			}
+		}
+		record.ClientCerts = append(certs, clientCertRecord{
+			Serial:  serial,
+			Subject: identity,
+			Issued:  now,
+			Expires: now.Add(ttl),
+		})
+	})
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	buff := &bytes.Buffer{}
+	w := zip.NewWriter(buff)
+	for _, f := range []struct {
+		name    string
+		content []byte
+	}{
+		{"ca.pem", ca.CertPEM},
+		{"cert.pem", cert.Cert},
+		{"key.pem", cert.Key},
+	} {
+		header := &zip.FileHeader{Name: f.name, Method: zip.Deflate}
+		header.SetMode(0600)
+		fw, err := w.CreateHeader(header)
+		if err == nil {
+			_, err = fw.Write(f.content)
+		}
+		if err != nil {
+			server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if err := w.Close(); err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	publishEvent(event{
+		Type:    "client-cert-issued",
+		Driver:  driverName,
+		Name:    hostName,
+		Message: identity + ":" + serial,
+	})
+	resp.Header().Set("Content-Type", "application/zip")
+	resp.Header().Set("Content-Disposition", "attachment; filename=certs.zip")
+	resp.Write(buff.Bytes())
+}
@@ -0,0 +1,43 @@
+package machine
+
+import (
+	"testing"
+)
+
+func TestShellValue(t *testing.T) {
+	for _, c := range []struct {
+		value  string
+		quoted string
+	}{
+		{"tcp://10.0.0.5:2376", `'tcp://10.0.0.5:2376'`},
+		{"$HOME/.docker/kat-machine/generic/a", `"$HOME"'/.docker/kat-machine/generic/a'`},
+		{"/certs/$(rm -rf ~)", `'/certs/$(rm -rf ~)'`},
+		{"/certs/it's", `'/certs/it'\''s'`},
+		{"$HOME/elsewhere", `'$HOME/elsewhere'`},
+	} {
+		if quoted := shellValue(c.value); quoted != c.quoted {
+			t.Errorf("%s: got %s, want %s", c.value, quoted, c.quoted)
+		}
+	}
+}
+
+func TestHostNamePattern(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		ok   bool
+	}{
+		{"ci-1", true},
+		{"web.prod", true},
+		{"A1", true},
+		{"-a", false},
+		{".a", false},
+		{"a/b", false},
+		{"a b", false},
+		{"a\"b", false},
+		{"", false},
+	} {
+		if ok := hostNamePattern.MatchString(c.name); ok != c.ok {
+			t.Errorf("%q: got %v", c.name, ok)
+		}
+	}
+}
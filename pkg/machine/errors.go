@@ -0,0 +1,42 @@
+package machine
+
+import (
+	"github.com/conductant/gohm/pkg/server"
+	"golang.org/x/net/context"
+	"net/http"
+)
+
+// An error together with the http status it is rendered with.  This lets the operations on
+// machines be shared by the handlers that render their errors and the ones that report them.
+type statusError struct {
+	Code    int
+	Message string
+}
+
+func (e *statusError) Error() string {
+	return e.Message
+}
+
+func newStatusError(code int, message string) error {
+	return &statusError{Code: code, Message: message}
+}
+
+// Status code for the error.  Errors without one are internal errors, except for those of
+// driver calls that timed out or were cancelled.
+func statusOf(err error) int {
+	switch err := err.(type) {
+	case *statusError:
+		return err.Code
+	}
+	switch err {
+	case ErrOperationTimeout, ErrWaitTimeout:
+		return http.StatusGatewayTimeout
+	case ErrOperationCancelled:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func renderError(ctx context.Context, err error) {
+	server.HandleError(ctx, statusOf(err), err.Error())
+}
@@ -0,0 +1,108 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Events kept in memory for the event listing.
+	maxEvents = 1000
+
+	eventWebhookTimeout = 10 * time.Second
+)
+
+// Something that happened to a machine without anyone asking, such as an upcoming expiry.
+// Events are listed through the api and posted to the webhook when one is set.
+type event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Driver  string    `json:"driver"`
+	Name    string    `json:"name"`
+	Message string    `json:"message,omitempty"`
+}
+
+var (
+	events     = []event{}
+	eventsLock sync.Mutex
+
+	eventWebhook     string
+	eventWebhookLock sync.Mutex
+)
+
+// Sets the url events are posted to as json.  An empty url turns the webhook off.
+func SetEventWebhook(url string) {
+	eventWebhookLock.Lock()
+	defer eventWebhookLock.Unlock()
+	eventWebhook = url
+}
+
+func publishEvent(e event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	glog.Infoln("Event", e.Type, e.Driver, e.Name, e.Message)
+
+	eventsLock.Lock()
+	events = append(events, e)
+	if len(events) > maxEvents {
+		events = events[len(events)-maxEvents:]
+	}
+	eventsLock.Unlock()
+
+	eventWebhookLock.Lock()
+	url := eventWebhook
+	eventWebhookLock.Unlock()
+	if url != "" {
+		go postEvent(url, e)
+	}
+}
+
+func postEvent(url string, e event) {
+	buff, err := json.Marshal(e)
+	if err != nil {
+		glog.Warningln("Cannot encode event", e.Type, "Err=", err)
+		return
+	}
+	client := &http.Client{Timeout: eventWebhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(buff))
+	if err != nil {
+		glog.Warningln("Cannot post event", e.Type, "to", url, "Err=", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		glog.Warningln("Cannot post event", e.Type, "to", url, "Status=", resp.Status)
+	}
+}
+
+// Lists the recent events, optionally only those of a type or after a time.
+func ListEvents(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	var since time.Time
+	if v := server.GetUrlParameter(req, "since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			server.HandleError(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+		since = t
+	}
+	eventType := server.GetUrlParameter(req, "type")
+
+	eventsLock.Lock()
+	list := []event{}
+	for _, e := range events {
+		if e.Time.After(since) && (eventType == "" || e.Type == eventType) {
+			list = append(list, e)
+		}
+	}
+	eventsLock.Unlock()
+
+	server.Marshal(resp, req, list)
+}
@@ -0,0 +1,240 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/conductant/gohm/pkg/server"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Auth scope needed to run commands on machines.
+	ExecScope = "machine-exec"
+
+	DefaultExecTimeout = 10 * time.Minute
+	MaxExecStdin       = 16 * 1024 * 1024
+
+	ExitCodeTrailer  = "X-Exit-Code"
+	ExitErrorTrailer = "X-Exit-Error"
+)
+
+var (
+	ErrNoCommand   = errors.New("err-no-command")
+	ErrExecTimeout = errors.New("err-exec-timeout")
+)
+
+// A command to run.  Stdin is either in the json, or the body itself when the command is
+// given as ?command= instead.
+type execRequest struct {
+	Command string `json:"command"`
+	Stdin   string `json:"stdin,omitempty"`
+	Timeout string `json:"timeout,omitempty"`
+}
+
+func readExecRequest(req *http.Request) (*execRequest, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, MaxExecStdin+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MaxExecStdin {
+		return nil, newStatusError(http.StatusRequestEntityTooLarge, "err-stdin-too-large")
+	}
+	// Only the query, since the body may be anything and must not be parsed as a form.
+	query := req.URL.Query()
+	r := &execRequest{
+		Command: query.Get("command"),
+		Timeout: query.Get("timeout"),
+	}
+	if r.Command != "" {
+		r.Stdin = string(body)
+	} else if len(body) > 0 {
+		if err := json.Unmarshal(body, r); err != nil {
+			return nil, newStatusError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if r.Command == "" {
+		return nil, newStatusError(http.StatusBadRequest, ErrNoCommand.Error())
+	}
+	return r, nil
+}
+
+// Writes the output of a command as it arrives, either as is or as server-sent events with
+// stdout and stderr told apart.
+type execOutput struct {
+	lock  sync.Mutex
+	resp  http.ResponseWriter
+	sse   bool
+	flush func()
+}
+
+func (o *execOutput) write(event string, data []byte) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var err error
+	if o.sse {
+		_, err = fmt.Fprintf(o.resp, "event: %s\ndata: %s\n\n", event, data)
+	} else {
+		_, err = o.resp.Write(data)
+	}
+	o.flush()
+	return err
+}
+
+func (o *execOutput) stream(event string) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		data := p
+		if o.sse {
+			data, _ = json.Marshal(string(p))
+		}
+		return len(p), o.write(event, data)
+	})
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// Runs a command on the machine over ssh and streams its output back.  The output is chunked,
+// with stdout and stderr as they come, or server-sent events with ?stream=sse.  The exit code
+// of the command arrives in the X-Exit-Code trailer, or the exit event.
+func ExecCommand(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+	sse := req.URL.Query().Get("stream") == "sse" ||
+		strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+
+	r, err := readExecRequest(req)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	timeout := DefaultExecTimeout
+	if r.Timeout != "" {
+		if timeout, err = time.ParseDuration(r.Timeout); err != nil || timeout <= 0 {
+			server.HandleError(ctx, http.StatusBadRequest, "err-bad-timeout:"+r.Timeout)
+			return
+		}
+	}
+
+	// Every command is audited, including those that never got to run.
+	audit := auditEntry{Action: "exec", Detail: r.Command}
+	started := time.Now()
+	defer func() {
+		audit.Duration = time.Since(started).String()
+		writeAudit(ctx, driverName, hostName, audit)
+	}()
+	fail := func(err error) {
+		audit.Status = statusOf(err)
+		renderError(ctx, err)
+	}
+
+	driver, err := restoreDriver(ctx, driverName, hostName)
+	if err != nil {
+		fail(err)
+		return
+	}
+	client, err := dialSSH(driver)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		fail(newStatusError(http.StatusBadGateway, err.Error()))
+		return
+	}
+	defer session.Close()
+
+	session.Stdin = bytes.NewBufferString(r.Stdin)
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		fail(err)
+		return
+	}
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := session.Start(r.Command); err != nil {
+		fail(newStatusError(http.StatusBadGateway, err.Error()))
+		return
+	}
+
+	// The command is killed when it runs out of time or the caller goes away.
+	done := make(chan struct{})
+	defer close(done)
+	killed := make(chan error, 1)
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			killed <- ErrExecTimeout
+		case <-req.Context().Done():
+			killed <- req.Context().Err()
+		case <-done:
+			return
+		}
+		session.Signal(ssh.SIGKILL)
+		client.Close()
+	}()
+
+	resp.Header().Set("Trailer", ExitCodeTrailer+", "+ExitErrorTrailer)
+	if sse {
+		resp.Header().Set("Content-Type", "text/event-stream")
+		resp.Header().Set("Cache-Control", "no-cache")
+	} else {
+		resp.Header().Set("Content-Type", "application/octet-stream")
+	}
+	resp.WriteHeader(http.StatusOK)
+	audit.Status = http.StatusOK
+
+	output := &execOutput{resp: resp, sse: sse, flush: func() {}}
+	if f, ok := resp.(http.Flusher); ok {
+		output.flush = f.Flush
+	}
+	copied := sync.WaitGroup{}
+	copied.Add(2)
+	go func() {
+		io.Copy(output.stream("stdout"), stdout)
+		copied.Done()
+	}()
+	go func() {
+		io.Copy(output.stream("stderr"), stderr)
+		copied.Done()
+	}()
+	copied.Wait()
+
+	err = session.Wait()
+	code := exitStatus(err)
+	select {
+	case err = <-killed:
+		code = -1
+	default:
+	}
+	audit.ExitCode = &code
+
+	if sse {
+		exit := map[string]interface{}{"exit_code": code}
+		if code < 0 && err != nil {
+			exit["error"] = err.Error()
+		}
+		data, _ := json.Marshal(exit)
+		output.write("exit", data)
+	}
+	resp.Header().Set(ExitCodeTrailer, fmt.Sprint(code))
+	if code < 0 && err != nil {
+		resp.Header().Set(ExitErrorTrailer, err.Error())
+	}
+}
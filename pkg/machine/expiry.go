@@ -0,0 +1,280 @@
+package machine
+
+import (
+	"errors"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultReaperInterval = 1 * time.Minute
+	DefaultExpiryWarning  = 1 * time.Hour
+
+	// What the reaper does with an expired machine.
+	ExpiryStop   = "stop"
+	ExpiryRemove = "remove"
+
+	// Auth scope needed to change or clear the expiry of a machine.
+	ExpiryScope = "machine-expiry"
+)
+
+var (
+	ErrBadExpiry = errors.New("err-bad-expiry")
+	ErrNoExpiry  = errors.New("err-no-expiry")
+)
+
+// When a machine expires and what is done with it then.
+type expiryRecord struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	Action    string    `json:"action"`
+
+	// Set once the warning event is sent and once the machine is reaped.  Extending the
+	// expiry clears both.
+	Warned *time.Time `json:"warned,omitempty"`
+	Reaped *time.Time `json:"reaped,omitempty"`
+}
+
+// Builds the expiry from either a ttl from now or an absolute time.  The action defaults to
+// removing the machine.
+func newExpiry(ttl string, expiresAt *time.Time, action string) (*expiryRecord, error) {
+	if ttl == "" && expiresAt == nil {
+		return nil, nil
+	}
+	if ttl != "" && expiresAt != nil {
+		return nil, newStatusError(http.StatusBadRequest, ErrBadExpiry.Error()+":ttl-and-expires_at")
+	}
+	expiry := &expiryRecord{Action: ExpiryRemove}
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return nil, newStatusError(http.StatusBadRequest, ErrBadExpiry.Error()+":"+ttl)
+		}
+		expiry.ExpiresAt = time.Now().Add(d)
+	} else {
+		// A time already past would have the machine reaped as soon as it is made.
+		if !expiresAt.After(time.Now()) {
+			return nil, newStatusError(http.StatusBadRequest, ErrBadExpiry.Error()+":"+expiresAt.Format(time.RFC3339))
+		}
+		expiry.ExpiresAt = *expiresAt
+	}
+	if action != "" {
+		expiry.Action = action
+	}
+	if err := checkExpiryAction(expiry.Action); err != nil {
+		return nil, err
+	}
+	return expiry, nil
+}
+
+func checkExpiryAction(action string) error {
+	switch action {
+	case ExpiryStop, ExpiryRemove:
+		return nil
+	}
+	return newStatusError(http.StatusBadRequest, ErrBadExpiry.Error()+":"+action)
+}
+
+// Sets or extends the expiry of a machine.  Takes ttl, the time from now, extend, the time
+// added to the current expiry or to now if it has passed, or expires_at; and optionally the
+// action.
+func SetExpiry(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+	ttl := server.GetUrlParameter(req, "ttl")
+	extend := server.GetUrlParameter(req, "extend")
+	action := server.GetUrlParameter(req, "action")
+
+	var expiresAt *time.Time
+	if v := server.GetUrlParameter(req, "expires_at"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			server.HandleError(ctx, http.StatusBadRequest, ErrBadExpiry.Error()+":"+v)
+			return
+		}
+		expiresAt = &t
+	}
+
+	unlock := lockMachine(driverName, hostName)
+	defer unlock()
+
+	if lifecycle, err := getLifecycle(ctx, driverName, hostName); err != nil || lifecycle == LifecycleNone || lifecycle == Removed {
+		server.HandleError(ctx, http.StatusNotFound, "err-not-found:"+hostName)
+		return
+	}
+	record, err := getMachineRecord(ctx, driverName, hostName)
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var expiry *expiryRecord
+	if extend != "" {
+		d, err := time.ParseDuration(extend)
+		if err != nil || d <= 0 || ttl != "" || expiresAt != nil {
+			server.HandleError(ctx, http.StatusBadRequest, ErrBadExpiry.Error()+":"+extend)
+			return
+		}
+		if record.Expiry == nil {
+			server.HandleError(ctx, http.StatusConflict, ErrNoExpiry.Error()+":"+hostName)
+			return
+		}
+		// An expiry that has passed is extended from now, or the machine would be reaped
+		// again as soon as it is extended.
+		from := time.Now()
+		if record.Expiry.ExpiresAt.After(from) {
+			from = record.Expiry.ExpiresAt
+		}
+		expiry = &expiryRecord{ExpiresAt: from.Add(d), Action: record.Expiry.Action}
+		if action != "" {
+			expiry.Action = action
+		}
+		if err := checkExpiryAction(expiry.Action); err != nil {
+			renderError(ctx, err)
+			return
+		}
+	} else {
+		if action == "" && record.Expiry != nil {
+			action = record.Expiry.Action
+		}
+		if expiry, err = newExpiry(ttl, expiresAt, action); err != nil {
+			renderError(ctx, err)
+			return
+		}
+		if expiry == nil {
+			server.HandleError(ctx, http.StatusBadRequest, ErrBadExpiry.Error()+":"+hostName)
+			return
+		}
+	}
+
+	err = updateMachineRecord(ctx, driverName, hostName, func(record *machineRecord) {
+		record.Expiry = expiry
+	})
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	journalOperation(ctx, driverName, hostName, journalEntry{Operation: "expiry"})
+	server.Marshal(resp, req, expiry)
+}
+
+// Clears the expiry so that the machine is kept until removed.
+func ClearExpiry(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+
+	unlock := lockMachine(driverName, hostName)
+	defer unlock()
+
+	if lifecycle, err := getLifecycle(ctx, driverName, hostName); err != nil || lifecycle == LifecycleNone {
+		server.HandleError(ctx, http.StatusNotFound, "err-not-found:"+hostName)
+		return
+	}
+	err := updateMachineRecord(ctx, driverName, hostName, func(record *machineRecord) {
+		record.Expiry = nil
+	})
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	journalOperation(ctx, driverName, hostName, journalEntry{Operation: "expiry"})
+	result := map[string]interface{}{
+		"name": hostName,
+	}
+	server.Marshal(resp, req, result)
+}
+
+// Warns about the machines that expire within the warning period, and stops or removes the
+// ones that have expired.
+func reapExpired(ctx context.Context, warning time.Duration) {
+	visitMachines(ctx, func(provider, hostName string) {
+		record, err := getMachineRecord(ctx, provider, hostName)
+		if err != nil || record.Expiry == nil || record.Expiry.Reaped != nil || record.Removed != nil {
+			return
+		}
+		expiry := record.Expiry
+		now := time.Now()
+		switch {
+		case !now.Before(expiry.ExpiresAt):
+			reapMachine(ctx, provider, hostName, expiry.Action)
+		case expiry.Warned == nil && expiry.ExpiresAt.Sub(now) <= warning:
+			publishEvent(event{
+				Type:    "expiry-warning",
+				Driver:  provider,
+				Name:    hostName,
+				Message: expiry.Action + " at " + expiry.ExpiresAt.Format(time.RFC3339),
+			})
+			journalOperation(ctx, provider, hostName, journalEntry{Operation: "expiry-warning"})
+			updateExpiry(ctx, provider, hostName, func(expiry *expiryRecord) {
+				expiry.Warned = &now
+			})
+		}
+	})
+}
+
+func reapMachine(ctx context.Context, provider, hostName, action string) {
+	var err error
+	switch action {
+	case ExpiryStop:
+		// A machine that is already stopped has nothing left to do.
+		if lifecycle, _ := getLifecycle(ctx, provider, hostName); lifecycle != Stopped {
+			_, err = changeState(ctx, provider, hostName, "stop", waitOptions{}, false)
+		}
+	default:
+		_, err = removeMachine(ctx, provider, hostName)
+	}
+	journalOperation(ctx, provider, hostName, journalEntry{Operation: "expire", Error: errorString(err)})
+
+	e := event{Type: "expired", Driver: provider, Name: hostName, Message: action}
+	if err != nil {
+		e.Type = "expiry-failed"
+		e.Message = action + ": " + err.Error()
+	}
+	publishEvent(e)
+
+	// Failures the server can do nothing about, such as a protected machine, are not
+	// retried.  The others are tried again on the next round.
+	if err == nil || statusOf(err) < http.StatusInternalServerError {
+		now := time.Now()
+		updateExpiry(ctx, provider, hostName, func(expiry *expiryRecord) {
+			expiry.Reaped = &now
+		})
+	}
+}
+
+func updateExpiry(ctx context.Context, provider, hostName string, update func(*expiryRecord)) {
+	err := updateMachineRecord(ctx, provider, hostName, func(record *machineRecord) {
+		if record.Expiry != nil {
+			update(record.Expiry)
+		}
+	})
+	if err != nil {
+		glog.Warningln("Cannot update expiry of", hostName, "Err=", err)
+	}
+}
+
+// Starts the reaper of expired machines.  Returns the function that stops it.
+func StartReaper(interval, warning time.Duration) func() {
+	if interval <= 0 {
+		interval = DefaultReaperInterval
+	}
+	if warning <= 0 {
+		warning = DefaultExpiryWarning
+	}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			reapExpired(context.Background(), warning)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
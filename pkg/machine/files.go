@@ -0,0 +1,370 @@
+package machine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/conductant/gohm/pkg/server"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Auth scope needed to copy files to and from machines.
+	FilesScope = "machine-files"
+
+	// The mode of a new file uploaded without one.
+	DefaultFileMode = 0644
+
+	FileModeHeader = "X-File-Mode"
+
+	// How much of the stderr of a transfer is kept for the error.
+	maxTransferStderr = 4096
+)
+
+var (
+	ErrBadPath        = errors.New("err-bad-path")
+	ErrBadFileMode    = errors.New("err-bad-file-mode")
+	ErrFileNotFound   = errors.New("err-file-not-found")
+	ErrFileDenied     = errors.New("err-file-denied")
+	ErrTransferFailed = errors.New("err-transfer-failed")
+	ErrShortBody      = errors.New("err-short-body")
+)
+
+// The options of a transfer, all in the query since the body is the content itself.
+type transfer struct {
+	Path    string
+	Mode    uint64
+	Sudo    bool
+	Archive bool
+
+	// Whether the mode was given.  Otherwise a file keeps the mode it has, and the directory
+	// an archive is unpacked into is left as it is.
+	ModeSet bool
+}
+
+func readTransfer(req *http.Request) (*transfer, error) {
+	query := req.URL.Query()
+	t := &transfer{
+		Path:    query.Get("path"),
+		Mode:    DefaultFileMode,
+		Sudo:    query.Get("sudo") == "true",
+		Archive: query.Get("archive") == "tar" || req.Header.Get("Content-Type") == "application/x-tar",
+	}
+	if !path.IsAbs(t.Path) || strings.ContainsAny(t.Path, "\x00\n") {
+		return nil, newStatusError(http.StatusBadRequest, ErrBadPath.Error()+":"+t.Path)
+	}
+	t.Path = path.Clean(t.Path)
+	if v := query.Get("mode"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || mode > 07777 {
+			return nil, newStatusError(http.StatusBadRequest, ErrBadFileMode.Error()+":"+v)
+		}
+		t.Mode, t.ModeSet = mode, true
+	}
+	return t, nil
+}
+
+// The command as run on the machine, through sudo when asked for.
+func (t *transfer) command(script string) string {
+	if t.Sudo {
+		return "sudo -n sh -c " + shellQuote(script)
+	}
+	return script
+}
+
+// Finds out what is at the path: a file with its mode and size, or a directory with its mode.
+func (t *transfer) stat(client *ssh.Client) (kind string, mode string, size int64, err error) {
+	p := shellQuote(t.Path)
+	script := fmt.Sprintf(`if [ ! -e %s ]; then echo missing; elif [ ! -r %s ]; then echo denied; `+
+		`elif [ -d %s ]; then echo directory $(stat -c %%a %s) 0; else echo file $(stat -c '%%a %%s' %s); fi`,
+		p, p, p, p, p)
+	session, err := client.NewSession()
+	if err != nil {
+		return "", "", 0, newStatusError(http.StatusBadGateway, err.Error())
+	}
+	defer session.Close()
+	out, err := session.Output(t.command(script))
+	if err != nil {
+		return "", "", 0, newStatusError(http.StatusBadGateway, ErrTransferFailed.Error()+":"+err.Error())
+	}
+	fields := strings.Fields(string(out))
+	switch {
+	case len(fields) == 1 && fields[0] == "missing":
+		return "", "", 0, newStatusError(http.StatusNotFound, ErrFileNotFound.Error()+":"+t.Path)
+	case len(fields) == 1 && fields[0] == "denied":
+		return "", "", 0, newStatusError(http.StatusForbidden, ErrFileDenied.Error()+":"+t.Path)
+	case len(fields) != 3:
+		return "", "", 0, newStatusError(http.StatusBadGateway, ErrTransferFailed.Error()+":"+string(out))
+	}
+	size, _ = strconv.ParseInt(fields[2], 10, 64)
+	return fields[0], fields[1], size, nil
+}
+
+// Keeps the start of what is written, for the stderr of a failed transfer.
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := maxTransferStderr - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Tells the errors of reading the body apart from those of writing it to the machine.
+type bodyReader struct {
+	io.Reader
+	err error
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// Runs a script to completion, with its stderr as the error when it fails.
+func (t *transfer) run(client *ssh.Client, script string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return newStatusError(http.StatusBadGateway, err.Error())
+	}
+	defer session.Close()
+	stderr := &limitedBuffer{}
+	session.Stderr = stderr
+	if err := session.Run(t.command(script)); err != nil {
+		return transferError(err, stderr)
+	}
+	return nil
+}
+
+func transferError(err error, stderr *limitedBuffer) error {
+	message := strings.TrimSpace(stderr.String())
+	if message == "" {
+		message = err.Error()
+	}
+	return newStatusError(http.StatusBadGateway, ErrTransferFailed.Error()+":"+message)
+}
+
+// Downloads a file from the machine over ssh, or a directory as a tar archive.  The body is
+// streamed as it is read, with the mode of the file in X-File-Mode.  A file that breaks off
+// comes short of its Content-Length, and an archive ends with the X-Exit-Error trailer.
+func GetFile(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+
+	t, err := readTransfer(req)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+
+	audit := auditEntry{Action: "files", Detail: "get " + t.Path}
+	started := time.Now()
+	defer func() {
+		audit.Duration = time.Since(started).String()
+		writeAudit(ctx, driverName, hostName, audit)
+	}()
+	fail := func(err error) {
+		audit.Status = statusOf(err)
+		renderError(ctx, err)
+	}
+
+	driver, err := restoreDriver(ctx, driverName, hostName)
+	if err != nil {
+		fail(err)
+		return
+	}
+	client, err := dialSSH(driver)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer client.Close()
+
+	kind, mode, size, err := t.stat(client)
+	if err != nil {
+		fail(err)
+		return
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		fail(newStatusError(http.StatusBadGateway, err.Error()))
+		return
+	}
+	defer session.Close()
+	stderr := &limitedBuffer{}
+	session.Stderr = stderr
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	name := path.Base(t.Path)
+	script := "cat " + shellQuote(t.Path)
+	if kind == "directory" {
+		name += ".tar"
+		script = "tar -C " + shellQuote(t.Path) + " -cf - ."
+		resp.Header().Set("Content-Type", "application/x-tar")
+		resp.Header().Set("Trailer", ExitErrorTrailer)
+	} else {
+		resp.Header().Set("Content-Type", "application/octet-stream")
+		resp.Header().Set("Content-Length", fmt.Sprint(size))
+	}
+	if err := session.Start(t.command(script)); err != nil {
+		fail(newStatusError(http.StatusBadGateway, err.Error()))
+		return
+	}
+
+	resp.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	resp.Header().Set(FileModeHeader, mode)
+	resp.WriteHeader(http.StatusOK)
+	audit.Status = http.StatusOK
+
+	n, err := io.Copy(resp, stdout)
+	if err == nil {
+		err = session.Wait()
+	}
+	if err != nil {
+		// The caller went away or the machine failed midway; the status is already sent.
+		session.Signal(ssh.SIGKILL)
+		err = transferError(err, stderr)
+		audit.Status = statusOf(err)
+		resp.Header().Set(ExitErrorTrailer, err.Error())
+	}
+	audit.Detail = fmt.Sprintf("get %s %d bytes", t.Path, n)
+}
+
+// Uploads the body to a file on the machine over ssh, or unpacks it into a directory with
+// ?archive=tar or a Content-Type of application/x-tar.  Files are written to a temporary file
+// next to the path and moved in place once all of the body is there, so a broken upload
+// leaves the old file.  Killing the command is not enough for that: sshd closes its stdin
+// when the connection goes, which looks to cat like the end of the content.
+func PutFile(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+
+	t, err := readTransfer(req)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+
+	audit := auditEntry{Action: "files", Detail: "put " + t.Path}
+	started := time.Now()
+	defer func() {
+		audit.Duration = time.Since(started).String()
+		writeAudit(ctx, driverName, hostName, audit)
+	}()
+	fail := func(err error) {
+		audit.Status = statusOf(err)
+		renderError(ctx, err)
+	}
+
+	driver, err := restoreDriver(ctx, driverName, hostName)
+	if err != nil {
+		fail(err)
+		return
+	}
+	client, err := dialSSH(driver)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		fail(newStatusError(http.StatusBadGateway, err.Error()))
+		return
+	}
+	defer session.Close()
+	stderr := &limitedBuffer{}
+	session.Stderr = stderr
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	p := shellQuote(t.Path)
+	mode := fmt.Sprintf("%04o", t.Mode)
+	tmp := shellQuote(path.Join(path.Dir(t.Path), "."+path.Base(t.Path)+".kat-machine"))
+	script := fmt.Sprintf("mkdir -p %s && cat > %s", shellQuote(path.Dir(t.Path)), tmp)
+	if t.Archive {
+		script = fmt.Sprintf("mkdir -p %s && tar -C %s -xf -", p, p)
+		if t.ModeSet {
+			script += fmt.Sprintf(" && chmod %s %s", mode, p)
+		}
+	}
+	if err := session.Start(t.command(script)); err != nil {
+		fail(newStatusError(http.StatusBadGateway, err.Error()))
+		return
+	}
+
+	body := &bodyReader{Reader: req.Body}
+	n, err := io.Copy(stdin, body)
+	if body.err == nil && err == nil && req.ContentLength >= 0 && n != req.ContentLength {
+		body.err = ErrShortBody
+	}
+	if body.err != nil {
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		if !t.Archive {
+			t.run(client, "rm -f "+tmp)
+		}
+		fail(newStatusError(http.StatusBadRequest, body.err.Error()))
+		return
+	}
+	// A failed write means the command is gone, and why is in its stderr.
+	stdin.Close()
+	if err := session.Wait(); err != nil {
+		fail(transferError(err, stderr))
+		return
+	}
+	// Only content of the full size is moved in place, with the mode of the file it replaces
+	// unless one is given.
+	if !t.Archive {
+		chmod := fmt.Sprintf("chmod %s %s", mode, tmp)
+		if !t.ModeSet {
+			chmod = fmt.Sprintf("{ if [ -e %s ]; then chmod $(stat -c %%a %s) %s; else %s; fi; }", p, p, tmp, chmod)
+		}
+		script = fmt.Sprintf("if [ $(wc -c < %s) -eq %d ]; then %s && mv -f %s %s; else rm -f %s; exit 1; fi",
+			tmp, n, chmod, tmp, p, tmp)
+		if err := t.run(client, script); err != nil {
+			fail(err)
+			return
+		}
+	}
+	if !t.ModeSet {
+		mode = ""
+		if _, actual, _, err := t.stat(client); err == nil {
+			if m, err := strconv.ParseUint(actual, 8, 32); err == nil {
+				mode = fmt.Sprintf("%04o", m)
+			}
+		}
+	}
+
+	audit.Status = http.StatusOK
+	audit.Detail = fmt.Sprintf("put %s %d bytes", t.Path, n)
+	server.Marshal(resp, req, map[string]interface{}{
+		"path":     t.Path,
+		"size":     n,
+		"mode":     mode,
+		"unpacked": t.Archive,
+	})
+}
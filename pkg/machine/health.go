@@ -0,0 +1,424 @@
+package machine
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Auth scope needed to change the probes of a machine or check it on demand.
+	HealthScope = "machine-health"
+
+	DefaultHealthInterval = 1 * time.Minute
+	DefaultProbeTimeout   = 10 * time.Second
+
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+
+	ProbeHTTP = "http"
+	ProbeTCP  = "tcp"
+
+	// How many results are kept with the machine.
+	maxHealthHistory = 60
+
+	// How many machines are checked at the same time.
+	healthWorkers = 8
+)
+
+var (
+	ErrBadProbe = errors.New("err-bad-probe")
+
+	// Only one round of checks runs on a machine at a time, be it periodic or on demand.
+	healthChecking     = map[string]bool{}
+	healthCheckingLock sync.Mutex
+)
+
+// A check of a service on the machine, beyond ssh and the Docker engine.  Http probes pass
+// with a 2xx or 3xx status unless another one is expected.
+type healthProbe struct {
+	Name    string `json:"name,omitempty"`
+	Type    string `json:"type"`
+	Port    int    `json:"port"`
+	Path    string `json:"path,omitempty"`
+	TLS     bool   `json:"tls,omitempty"`
+	Status  int    `json:"status,omitempty"`
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// The outcome of one check in a round.
+type healthCheck struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+	Latency string `json:"latency,omitempty"`
+}
+
+// The outcome of a round of checks.  The machine is healthy when all of them pass.
+type healthResult struct {
+	Time   time.Time     `json:"time"`
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks"`
+}
+
+// The health of a machine as kept in its record, with the latest results first.
+type healthRecord struct {
+	Probes  []healthProbe  `json:"probes,omitempty"`
+	Status  string         `json:"status,omitempty"`
+	Since   *time.Time     `json:"since,omitempty"`
+	History []healthResult `json:"history,omitempty"`
+}
+
+// Checks the probes and names the unnamed ones after what they check.
+func normalizeProbes(probes []healthProbe) ([]healthProbe, error) {
+	normalized := []healthProbe{}
+	for _, probe := range probes {
+		if probe.Port <= 0 || probe.Port > 65535 {
+			return nil, newStatusError(http.StatusBadRequest, fmt.Sprintf("%s:port:%d", ErrBadProbe, probe.Port))
+		}
+		if probe.Timeout != "" {
+			if t, err := time.ParseDuration(probe.Timeout); err != nil || t <= 0 {
+				return nil, newStatusError(http.StatusBadRequest, ErrBadProbe.Error()+":timeout:"+probe.Timeout)
+			}
+		}
+		switch probe.Type {
+		case ProbeHTTP:
+			if probe.Path == "" {
+				probe.Path = "/"
+			}
+			if probe.Path[0] != '/' {
+				return nil, newStatusError(http.StatusBadRequest, ErrBadProbe.Error()+":path:"+probe.Path)
+			}
+		case ProbeTCP:
+		default:
+			return nil, newStatusError(http.StatusBadRequest, ErrBadProbe.Error()+":type:"+probe.Type)
+		}
+		if probe.Name == "" {
+			probe.Name = probe.Type + ":" + strconv.Itoa(probe.Port)
+		}
+		normalized = append(normalized, probe)
+	}
+	return normalized, nil
+}
+
+func (p healthProbe) timeout() time.Duration {
+	if t, err := time.ParseDuration(p.Timeout); err == nil && t > 0 {
+		return t
+	}
+	return DefaultProbeTimeout
+}
+
+func (p healthProbe) run(ip string) error {
+	address := net.JoinHostPort(ip, strconv.Itoa(p.Port))
+	if p.Type == ProbeTCP {
+		conn, err := net.DialTimeout("tcp", address, p.timeout())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	u := url.URL{Scheme: "http", Host: address, Path: p.Path}
+	if p.TLS {
+		u.Scheme = "https"
+	}
+	// The probe is of the service itself: redirects are not followed, and certificates are not
+	// verified since services on machines seldom have ones the server would trust.
+	client := &http.Client{
+		Timeout: p.timeout(),
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case p.Status != 0 && resp.StatusCode != p.Status:
+		return fmt.Errorf("status %d", resp.StatusCode)
+	case p.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 400):
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func timeCheck(name string, check func() error) healthCheck {
+	started := time.Now()
+	err := check()
+	result := healthCheck{Name: name, Healthy: err == nil, Latency: time.Since(started).String()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Pings the Docker API of the machine at the url of the driver, with the client certificate
+// the server uses with the engines it installs.
+func pingDocker(ctx context.Context, engine string) error {
+	u, err := url.Parse(engine)
+	if err != nil || u.Host == "" {
+		return ErrNoEngine
+	}
+	transport, err := getProxyTransport(ctx)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: transport, Timeout: DefaultProbeTimeout}
+	resp, err := client.Get((&url.URL{Scheme: "https", Host: u.Host, Path: "/_ping"}).String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Runs a round of checks on the machine: ssh, the Docker engine when the machine has one, be
+// it installed at create or reported by the driver, and the probes of the machine.
+func checkHealth(ctx context.Context, provider, hostName string, record *machineRecord) healthResult {
+	result := healthResult{Time: time.Now(), Status: HealthHealthy, Checks: []healthCheck{}}
+	driver, err := restoreDriver(ctx, provider, hostName)
+	if err != nil {
+		result.Status = HealthUnhealthy
+		result.Checks = append(result.Checks, healthCheck{Name: "driver", Error: err.Error()})
+		return result
+	}
+
+	result.Checks = append(result.Checks, timeCheck("ssh", func() error {
+		_, code, err := runSSHCommand(driver, "true", nil, DefaultProbeTimeout)
+		if err == nil && code != 0 {
+			err = fmt.Errorf("exit status %d", code)
+		}
+		return err
+	}))
+	if engine, err := engineURL(driver, record); err == nil {
+		result.Checks = append(result.Checks, timeCheck("docker", func() error {
+			return pingDocker(ctx, engine)
+		}))
+	}
+	if record.Health != nil && len(record.Health.Probes) > 0 {
+		ip, err := driver.GetIP()
+		for _, probe := range record.Health.Probes {
+			probe := probe
+			result.Checks = append(result.Checks, timeCheck(probe.Name, func() error {
+				if err != nil {
+					return err
+				}
+				return probe.run(ip)
+			}))
+		}
+	}
+	for _, check := range result.Checks {
+		if !check.Healthy {
+			result.Status = HealthUnhealthy
+		}
+	}
+	return result
+}
+
+// Records the result with the machine, and sends an event when the machine turns unhealthy
+// or recovers.
+func recordHealth(ctx context.Context, provider, hostName string, result healthResult) {
+	previous := ""
+	err := updateMachineRecord(ctx, provider, hostName, func(record *machineRecord) {
+		if record.Health == nil {
+			record.Health = &healthRecord{}
+		}
+		health := record.Health
+		previous = health.Status
+		if health.Status != result.Status {
+			health.Status = result.Status
+			health.Since = &result.Time
+		}
+		health.History = append([]healthResult{result}, health.History...)
+		if len(health.History) > maxHealthHistory {
+			health.History = health.History[:maxHealthHistory]
+		}
+	})
+	if err != nil {
+		glog.Warningln("Cannot record health of", hostName, "Err=", err)
+		return
+	}
+
+	switch {
+	case result.Status == HealthUnhealthy && previous != HealthUnhealthy:
+		failed := []string{}
+		for _, check := range result.Checks {
+			if !check.Healthy {
+				failed = append(failed, check.Name+": "+check.Error)
+			}
+		}
+		publishEvent(event{Type: "machine-unhealthy", Driver: provider, Name: hostName, Message: strings.Join(failed, "; ")})
+	case result.Status == HealthHealthy && previous == HealthUnhealthy:
+		publishEvent(event{Type: "machine-recovered", Driver: provider, Name: hostName})
+	}
+}
+
+// Checks the machine and records the result, unless it is already being checked.  Only
+// machines that are up, as far as their lifecycle tells, are checked.
+func healthCheckMachine(ctx context.Context, provider, hostName string) (*healthResult, bool) {
+	key := provider + "/" + hostName
+	healthCheckingLock.Lock()
+	if healthChecking[key] {
+		healthCheckingLock.Unlock()
+		return nil, false
+	}
+	healthChecking[key] = true
+	healthCheckingLock.Unlock()
+	defer func() {
+		healthCheckingLock.Lock()
+		delete(healthChecking, key)
+		healthCheckingLock.Unlock()
+	}()
+
+	record, err := getMachineRecord(ctx, provider, hostName)
+	if err != nil || record.Removed != nil {
+		return nil, false
+	}
+	if lifecycle, _ := getLifecycle(ctx, provider, hostName); lifecycle != Created && lifecycle != Running {
+		// The health of a machine that is down tells nothing, and should not show in listings.
+		if record.Health != nil && record.Health.Status != "" {
+			updateMachineRecord(ctx, provider, hostName, func(record *machineRecord) {
+				record.Health.Status, record.Health.Since = "", nil
+			})
+		}
+		return nil, false
+	}
+	result := checkHealth(ctx, provider, hostName, record)
+	recordHealth(ctx, provider, hostName, result)
+	return &result, true
+}
+
+func checkAllHealth(ctx context.Context) {
+	workers := make(chan struct{}, healthWorkers)
+	wait := sync.WaitGroup{}
+	visitMachines(ctx, func(provider, hostName string) {
+		workers <- struct{}{}
+		wait.Add(1)
+		go func() {
+			defer func() {
+				<-workers
+				wait.Done()
+			}()
+			healthCheckMachine(ctx, provider, hostName)
+		}()
+	})
+	wait.Wait()
+}
+
+// Starts the periodic health checks of the machines.  Returns the function that stops them.
+func StartHealthChecks(interval time.Duration) func() {
+	if interval <= 0 {
+		interval = DefaultHealthInterval
+	}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			checkAllHealth(context.Background())
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+func getHealth(ctx context.Context, provider, hostName string) (*healthRecord, error) {
+	if _, err := restoreDriver(ctx, provider, hostName); err != nil {
+		return nil, err
+	}
+	record, err := getMachineRecord(ctx, provider, hostName)
+	if err != nil {
+		return nil, err
+	}
+	if record.Health == nil {
+		return &healthRecord{Probes: []healthProbe{}, History: []healthResult{}}, nil
+	}
+	return record.Health, nil
+}
+
+// The health of the machine with the results of the last checks.  ?history=n keeps the
+// latest n of them.
+func GetHealth(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+	health, err := getHealth(ctx, driverName, hostName)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if n, err := strconv.Atoi(server.GetUrlParameter(req, "history")); err == nil && n >= 0 && n < len(health.History) {
+		health.History = health.History[:n]
+	}
+	server.Marshal(resp, req, health)
+}
+
+// Checks the machine now rather than waiting for the next round.
+func CheckHealth(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+	if _, err := getHealth(ctx, driverName, hostName); err != nil {
+		renderError(ctx, err)
+		return
+	}
+	result, checked := healthCheckMachine(ctx, driverName, hostName)
+	if !checked {
+		lifecycle, _ := getLifecycle(ctx, driverName, hostName)
+		server.HandleError(ctx, http.StatusConflict, ErrInvalidTransition.Error()+":"+string(lifecycle))
+		return
+	}
+	writeAudit(ctx, driverName, hostName, auditEntry{Action: "health", Detail: result.Status, Status: http.StatusOK})
+	server.Marshal(resp, req, result)
+}
+
+// Replaces the probes of the machine.  They are checked from the next round on.
+func SetHealthProbes(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+	if _, err := getHealth(ctx, driverName, hostName); err != nil {
+		renderError(ctx, err)
+		return
+	}
+	probes := []healthProbe{}
+	if err := server.Unmarshal(resp, req, &probes); err != nil {
+		return
+	}
+	probes, err := normalizeProbes(probes)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	err = updateMachineRecord(ctx, driverName, hostName, func(record *machineRecord) {
+		if record.Health == nil {
+			record.Health = &healthRecord{}
+		}
+		record.Health.Probes = probes
+	})
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAudit(ctx, driverName, hostName, auditEntry{Action: "health-probes", Detail: fmt.Sprintf("%d probes", len(probes)), Status: http.StatusOK})
+	server.Marshal(resp, req, probes)
+}
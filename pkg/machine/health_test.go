@@ -0,0 +1,41 @@
+package machine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeProbes(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		probes []healthProbe
+		want   []healthProbe
+	}{
+		{"none", nil, []healthProbe{}},
+		{"named after what they check",
+			[]healthProbe{{Type: ProbeHTTP, Port: 80}, {Type: ProbeTCP, Port: 5432}},
+			[]healthProbe{{Name: "http:80", Type: ProbeHTTP, Port: 80, Path: "/"}, {Name: "tcp:5432", Type: ProbeTCP, Port: 5432}}},
+		{"names and paths kept",
+			[]healthProbe{{Name: "api", Type: ProbeHTTP, Port: 8443, Path: "/healthz", TLS: true, Status: 204, Timeout: "2s"}},
+			[]healthProbe{{Name: "api", Type: ProbeHTTP, Port: 8443, Path: "/healthz", TLS: true, Status: 204, Timeout: "2s"}}},
+		{"bad type", []healthProbe{{Type: "udp", Port: 53}}, nil},
+		{"no type", []healthProbe{{Port: 80}}, nil},
+		{"no port", []healthProbe{{Type: ProbeTCP}}, nil},
+		{"port out of range", []healthProbe{{Type: ProbeTCP, Port: 65536}}, nil},
+		{"relative path", []healthProbe{{Type: ProbeHTTP, Port: 80, Path: "healthz"}}, nil},
+		{"bad timeout", []healthProbe{{Type: ProbeTCP, Port: 22, Timeout: "soon"}}, nil},
+		{"negative timeout", []healthProbe{{Type: ProbeTCP, Port: 22, Timeout: "-1s"}}, nil},
+		{"one bad among good ones", []healthProbe{{Type: ProbeTCP, Port: 22}, {Type: ProbeTCP, Port: 0}}, nil},
+	} {
+		probes, err := normalizeProbes(c.probes)
+		if c.want == nil {
+			if err == nil || statusOf(err) != 400 {
+				t.Errorf("%s: got %v %v", c.name, probes, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(probes, c.want) {
+			t.Errorf("%s: got %v %v, want %v", c.name, probes, err, c.want)
+		}
+	}
+}
@@ -6,8 +6,73 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path"
+	"strconv"
+	"time"
 )
 
+// Listing entry for a host when details are asked for with ?details=true.
+type hostSummary struct {
+	Name      string            `json:"name"`
+	Driver    string            `json:"driver"`
+	Account   string            `json:"account,omitempty"`
+	State     string            `json:"state,omitempty"`
+	Lifecycle Lifecycle         `json:"lifecycle"`
+	Protected bool              `json:"protected,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Expires   *time.Time        `json:"expires,omitempty"`
+	Cluster   *clusterRole      `json:"cluster,omitempty"`
+	Health    string            `json:"health,omitempty"`
+	Removed   *time.Time        `json:"removed,omitempty"`
+}
+
+func getHostSummary(ctx context.Context, provider, hostName string) hostSummary {
+	summary := hostSummary{Name: hostName, Driver: provider}
+	if driver := accountDriver(provider); driver != "" && driver != provider {
+		summary.Driver, summary.Account = driver, provider
+	}
+	if record, err := getMachineRecord(ctx, provider, hostName); err == nil {
+		summary.State = record.State
+		summary.Protected = record.Protected
+		summary.Labels = record.Labels
+		summary.Cluster = record.Cluster
+		if record.Health != nil {
+			summary.Health = record.Health.Status
+		}
+		if record.Expiry != nil && record.Expiry.Reaped == nil {
+			summary.Expires = &record.Expiry.ExpiresAt
+		}
+	}
+	summary.Lifecycle, _ = getLifecycle(ctx, provider, hostName)
+	if removed, ok := getRemovedTime(ctx, provider, hostName); ok {
+		summary.Removed = &removed
+	}
+	return summary
+}
+
+// Options shared by the listings.  Removed machines are left out unless include_removed is set.
+// Listings of all hosts are grouped by account unless group_by is driver.
+type listOptions struct {
+	details        bool
+	includeRemoved bool
+	byDriver       bool
+}
+
+func getListOptions(req *http.Request) listOptions {
+	opts := listOptions{}
+	opts.details, _ = strconv.ParseBool(server.GetUrlParameter(req, "details"))
+	opts.includeRemoved, _ = strconv.ParseBool(server.GetUrlParameter(req, "include_removed"))
+	opts.byDriver = server.GetUrlParameter(req, "group_by") == "driver"
+	return opts
+}
+
+func (o listOptions) visible(ctx context.Context, provider, hostName string) bool {
+	if o.includeRemoved {
+		return true
+	}
+	_, removed := getRemovedTime(ctx, provider, hostName)
+	return !removed
+}
+
 func ListAllHosts(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
 	p := getStoreRoot(ctx)
 	drivers, err := ioutil.ReadDir(p)
@@ -15,11 +80,37 @@ func ListAllHosts(ctx context.Context, resp http.ResponseWriter, req *http.Reque
 		server.HandleError(ctx, http.StatusNotFound, "not-found:"+p)
 		return
 	}
+	opts := getListOptions(req)
 	result := map[string][]string{}
+	summaries := map[string][]hostSummary{}
 	for _, driver := range drivers {
-		list := []string{}
-		visitDir(path.Join(getStorePath(ctx, driver.Name()), "machines"), func(e string) { list = append(list, e) })
-		result[driver.Name()] = list
+		// The store root also has directories that are not accounts, such as the schedules.
+		provider := driver.Name()
+		if !isProvider(provider) {
+			continue
+		}
+		// Grouped by driver, the machines of an account are named account/name.
+		group, prefix := provider, ""
+		if d := accountDriver(provider); opts.byDriver && d != provider {
+			group, prefix = d, provider+"/"
+		}
+		if _, has := result[group]; !has {
+			result[group] = []string{}
+			summaries[group] = []hostSummary{}
+		}
+		visitDir(path.Join(getStorePath(ctx, provider), "machines"), func(e string) {
+			if !opts.visible(ctx, provider, e) {
+				return
+			}
+			result[group] = append(result[group], prefix+e)
+			if opts.details {
+				summaries[group] = append(summaries[group], getHostSummary(ctx, provider, e))
+			}
+		})
+	}
+	if opts.details {
+		server.Marshal(resp, req, summaries)
+		return
 	}
 	server.Marshal(resp, req, result)
 }
@@ -27,13 +118,37 @@ func ListAllHosts(ctx context.Context, resp http.ResponseWriter, req *http.Reque
 func ListAllHostsByDriver(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
 	driver := server.GetUrlParameter(req, "driver")
 	p := path.Join(getStorePath(ctx, driver), "machines")
+	opts := getListOptions(req)
 	hosts := []string{}
+	summaries := []hostSummary{}
 	visitDir(p, func(e string) {
+		if !opts.visible(ctx, driver, e) {
+			return
+		}
 		hosts = append(hosts, e)
+		if opts.details {
+			summaries = append(summaries, getHostSummary(ctx, driver, e))
+		}
 	})
+	if opts.details {
+		server.Marshal(resp, req, summaries)
+		return
+	}
 	server.Marshal(resp, req, hosts)
 }
 
+// Visits every machine in the store, of the accounts and drivers that are known.
+func visitMachines(ctx context.Context, visit func(provider, hostName string)) {
+	visitDir(getStoreRoot(ctx), func(provider string) {
+		if !isProvider(provider) {
+			return
+		}
+		visitDir(path.Join(getStoreRoot(ctx), provider, "machines"), func(hostName string) {
+			visit(provider, hostName)
+		})
+	})
+}
+
 func visitDir(path string, visit func(string)) {
 	list, err := ioutil.ReadDir(path)
 	if err != nil {
@@ -0,0 +1,101 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// An entry in the journal of a machine.  Unlike the log, which keeps snapshots of the driver
+// state, the journal records each thing that was done to the machine and how it went.
+type journalEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Phase     string    `json:"phase,omitempty"`
+	Attempt   int       `json:"attempt,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Retryable bool      `json:"retryable,omitempty"`
+	Orphaned  bool      `json:"orphaned,omitempty"`
+
+	// The run of the server that wrote the entry, to tell operations cut short by a restart.
+	Server string `json:"server,omitempty"`
+}
+
+// Phases of an operation.  Entries without a phase are single attempts of the driver call.
+const (
+	phaseBegin     = "begin"
+	phaseEnd       = "end"
+	phaseAbandoned = "abandoned"
+)
+
+var (
+	serverRun = mcnutils.TruncateID(mcnutils.GenerateRandomID())
+)
+
+func getMachineJournalPath(ctx context.Context, provider, hostName string) string {
+	journalPath := path.Join(getMachinePath(ctx, provider, hostName), "journal")
+	err := os.MkdirAll(journalPath, 0755)
+	if err != nil {
+		panic(err)
+	}
+	return journalPath
+}
+
+func writeJournal(ctx context.Context, provider, hostName string, entry journalEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.Server == "" {
+		entry.Server = serverRun
+	}
+	buff, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// Nanosecond, zero padded timestamps keep the entries in order when listing the directory.
+	p := path.Join(getMachineJournalPath(ctx, provider, hostName),
+		fmt.Sprintf("%020d-%s.json", entry.Time.UnixNano(), entry.Operation))
+	return ioutil.WriteFile(p, buff, 0644)
+}
+
+func readJournal(ctx context.Context, provider, hostName string) ([]journalEntry, error) {
+	p := path.Join(machineDir(ctx, provider, hostName), "journal")
+	entries := []journalEntry{}
+	list, err := ioutil.ReadDir(p)
+	switch {
+	case os.IsNotExist(err):
+		return entries, nil
+	case err != nil:
+		return nil, err
+	}
+	for _, f := range list {
+		buff, err := ioutil.ReadFile(path.Join(p, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		entry := journalEntry{}
+		if err := json.Unmarshal(buff, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func GetJournal(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+	entries, err := readJournal(ctx, driverName, hostName)
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	server.Marshal(resp, req, entries)
+}
@@ -0,0 +1,344 @@
+package machine
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/docker/machine/libmachine/drivers"
+	mcnssh "github.com/docker/machine/libmachine/ssh"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// Auth scope needed to rotate the ssh key of machines.
+	KeyScope = "machine-keys"
+)
+
+var (
+	ErrNoKey         = errors.New("err-no-ssh-key")
+	ErrKeyNotManaged = errors.New("err-ssh-key-not-managed")
+	ErrKeyRejected   = errors.New("err-ssh-key-rejected")
+	ErrRotateFailed  = errors.New("err-ssh-key-rotate-failed")
+)
+
+// The ssh key of a machine.  The private key is kept where the driver reads it, in the
+// machine directory, and never leaves the server.
+type sshKeyRecord struct {
+	Fingerprint string     `json:"fingerprint"`
+	Generated   time.Time  `json:"generated"`
+	Rotated     *time.Time `json:"rotated,omitempty"`
+
+	// Fingerprints of the keys rotated out, oldest first.
+	Previous []string `json:"previous,omitempty"`
+}
+
+func getMachineKeysPath(ctx context.Context, provider, hostName string) string {
+	keysPath := path.Join(getMachinePath(ctx, provider, hostName), "keys")
+	err := os.MkdirAll(keysPath, 0700)
+	if err != nil {
+		panic(err)
+	}
+	return keysPath
+}
+
+// The path of the private key of the driver, if it is one kat-machine looks after.  Keys the
+// driver keeps elsewhere, or a driver going by the ssh agent, are left alone.
+func managedKeyPath(ctx context.Context, provider string, driver drivers.Driver, hostName string) (string, error) {
+	p := driver.GetSSHKeyPath()
+	if p == "" {
+		return "", newStatusError(http.StatusNotFound, ErrNoKey.Error()+":"+hostName)
+	}
+	if path.Clean(path.Dir(p)) != path.Clean(machineDir(ctx, provider, hostName)) {
+		return "", newStatusError(http.StatusConflict, ErrKeyNotManaged.Error()+":"+p)
+	}
+	return p, nil
+}
+
+// Generates a key for the machine before it is created, so that every machine has its own
+// whatever the driver does.  Drivers that generate keys themselves find it already there, and
+// those that import a key given in the flags write over it.
+func generateMachineKey(ctx context.Context, provider string, driver drivers.Driver, hostName string) error {
+	p, err := managedKeyPath(ctx, provider, driver, hostName)
+	if err != nil {
+		return nil
+	}
+	getMachinePath(ctx, provider, hostName)
+	return mcnssh.GenerateSSHKey(p)
+}
+
+// Reads the public key from the private key, since drivers that import a key do not copy
+// the public half.
+func readPublicKey(privateKeyPath string) (ssh.PublicKey, error) {
+	buff, err := ioutil.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(buff)
+	if err != nil {
+		return nil, err
+	}
+	return signer.PublicKey(), nil
+}
+
+// The fingerprint of the key as OpenSSH shows it.
+func fingerprintSHA256(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + strings.TrimRight(base64.StdEncoding.EncodeToString(sum[:]), "=")
+}
+
+// The older fingerprint, which providers such as EC2 and DigitalOcean show for imported keys.
+func fingerprintMD5(key ssh.PublicKey) string {
+	sum := md5.Sum(key.Marshal())
+	hex := []string{}
+	for _, b := range sum {
+		hex = append(hex, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(hex, ":")
+}
+
+// The record of the key the machine was created with.  Nil when the key is not managed.
+func newKeyRecord(ctx context.Context, provider string, driver drivers.Driver, hostName string) *sshKeyRecord {
+	p, err := managedKeyPath(ctx, provider, driver, hostName)
+	if err != nil {
+		return nil
+	}
+	key, err := readPublicKey(p)
+	if err != nil {
+		glog.Warningln("Cannot read ssh key of", hostName, "Err=", err)
+		return nil
+	}
+	// A key imported by the driver replaced the generated one, but not its public half.
+	if err := ioutil.WriteFile(p+".pub", ssh.MarshalAuthorizedKey(key), 0600); err != nil {
+		glog.Warningln("Cannot write public key of", hostName, "Err=", err)
+	}
+	return &sshKeyRecord{Fingerprint: fingerprintSHA256(key), Generated: time.Now()}
+}
+
+func renderKey(key ssh.PublicKey, record *sshKeyRecord) map[string]interface{} {
+	result := map[string]interface{}{
+		"type":        key.Type(),
+		"public_key":  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		"fingerprint": fingerprintSHA256(key),
+		"md5":         fingerprintMD5(key),
+	}
+	if record != nil {
+		result["generated"] = record.Generated
+		result["rotated"] = record.Rotated
+		result["previous"] = record.Previous
+	}
+	return result
+}
+
+// Gets the public key of the machine and its fingerprints.
+func GetSSHKey(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+
+	driver, err := restoreDriver(ctx, driverName, hostName)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	p := driver.GetSSHKeyPath()
+	if p == "" {
+		server.HandleError(ctx, http.StatusNotFound, ErrNoKey.Error()+":"+hostName)
+		return
+	}
+	key, err := readPublicKey(p)
+	switch {
+	case os.IsNotExist(err):
+		server.HandleError(ctx, http.StatusNotFound, ErrNoKey.Error()+":"+hostName)
+		return
+	case err != nil:
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	record, err := getMachineRecord(ctx, driverName, hostName)
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	server.Marshal(resp, req, renderKey(key, record.SSHKey))
+}
+
+// Runs a script over the connection, with its output as the error when it fails.
+func runSSHScript(client *ssh.Client, script string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	out, err := session.CombinedOutput(script)
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// The part of an authorized key line that identifies the key, for grep to find it whatever
+// the options and comment around it.
+func keyBlob(key ssh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key.Marshal())
+}
+
+// Replaces the ssh key of the machine.  The new key is added to the authorized keys of the
+// ssh user with the old key, verified by logging in with it, and only then is the old key
+// removed from the machine and from the store.  A new key that cannot log in is taken off
+// again and the old key kept.  Keys registered with the provider at create are not touched.
+func RotateSSHKey(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+
+	unlock := lockMachine(driverName, hostName)
+	defer unlock()
+
+	if lifecycle, err := getLifecycle(ctx, driverName, hostName); err != nil || lifecycle == LifecycleNone {
+		server.HandleError(ctx, http.StatusNotFound, "err-not-found:"+hostName)
+		return
+	}
+	driver, err := restoreDriver(ctx, driverName, hostName)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	keyPath, err := managedKeyPath(ctx, driverName, driver, hostName)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	oldKey, err := readPublicKey(keyPath)
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	audit := auditEntry{Action: "ssh-key", Detail: "rotate " + fingerprintSHA256(oldKey)}
+	defer func() {
+		writeAudit(ctx, driverName, hostName, audit)
+	}()
+	journalOperation(ctx, driverName, hostName, journalEntry{Operation: "rotate-key", Phase: phaseBegin})
+	fail := func(err error) {
+		journalOperation(ctx, driverName, hostName, journalEntry{Operation: "rotate-key", Phase: phaseEnd, Error: err.Error()})
+		audit.Status = statusOf(err)
+		renderError(ctx, err)
+	}
+
+	pair, err := mcnssh.NewKeyPair()
+	if err != nil {
+		fail(err)
+		return
+	}
+	newPath := path.Join(getMachineKeysPath(ctx, driverName, hostName), fmt.Sprintf("id_rsa.%d", time.Now().Unix()))
+	if err := pair.WriteToFile(newPath, newPath+".pub"); err != nil {
+		fail(err)
+		return
+	}
+	newKey, _, _, _, err := ssh.ParseAuthorizedKey(pair.PublicKey)
+	if err != nil {
+		fail(err)
+		return
+	}
+	discard := func() {
+		os.Remove(newPath)
+		os.Remove(newPath + ".pub")
+	}
+
+	oldClient, err := dialSSH(driver)
+	if err != nil {
+		discard()
+		fail(err)
+		return
+	}
+	defer oldClient.Close()
+
+	line := shellQuote(strings.TrimSpace(string(pair.PublicKey)) + " kat-machine:" + hostName)
+	add := "mkdir -p ~/.ssh && chmod 700 ~/.ssh && touch ~/.ssh/authorized_keys && " +
+		"chmod 600 ~/.ssh/authorized_keys && echo " + line + " >> ~/.ssh/authorized_keys"
+	if err := runSSHScript(oldClient, add); err != nil {
+		discard()
+		fail(newStatusError(http.StatusBadGateway, ErrRotateFailed.Error()+":"+err.Error()))
+		return
+	}
+
+	// Writing through cat keeps the owner and mode of the file.  Grep exits 1 when it leaves
+	// no line, which is only an error if the key that is kept is gone too; the file is not
+	// replaced unless that key is in what is written.
+	remove := func(client *ssh.Client, key, keep ssh.PublicKey) error {
+		tmp := "~/.ssh/authorized_keys.kat-machine"
+		return runSSHScript(client, "grep -vF "+shellQuote(keyBlob(key))+" ~/.ssh/authorized_keys > "+tmp+"; s=$?; "+
+			"if [ $s -gt 1 ]; then :; "+
+			"elif grep -qF "+shellQuote(keyBlob(keep))+" "+tmp+"; then cat "+tmp+" > ~/.ssh/authorized_keys; s=$?; "+
+			"else echo err-key-missing >&2; s=1; fi; "+
+			"rm -f "+tmp+"; exit $s")
+	}
+
+	newClient, err := dialSSHWithKey(driver, newPath)
+	if err == nil {
+		err = runSSHScript(newClient, "true")
+		defer newClient.Close()
+	}
+	if err != nil {
+		if err := remove(oldClient, newKey, oldKey); err != nil {
+			glog.Warningln("Cannot take rejected key off", hostName, "Err=", err)
+		}
+		discard()
+		fail(newStatusError(http.StatusBadGateway, ErrKeyRejected.Error()+":"+err.Error()))
+		return
+	}
+	if err := remove(newClient, oldKey, newKey); err != nil {
+		// Both keys work, so the new one is kept for the next attempt to finish the job.
+		fail(newStatusError(http.StatusBadGateway, ErrRotateFailed.Error()+":"+err.Error()))
+		return
+	}
+
+	// The old key is no longer good on the machine.  Should the server go down now, the new
+	// key is still in the keys directory.
+	if err := os.Rename(newPath, keyPath); err != nil {
+		fail(err)
+		return
+	}
+	if err := os.Rename(newPath+".pub", keyPath+".pub"); err != nil {
+		glog.Warningln("Cannot move public key of", hostName, "Err=", err)
+	}
+
+	now := time.Now()
+	var record *sshKeyRecord
+	err = updateMachineRecord(ctx, driverName, hostName, func(r *machineRecord) {
+		previous := []string{fingerprintSHA256(oldKey)}
+		if r.SSHKey != nil {
+			previous = append(r.SSHKey.Previous, previous...)
+		}
+		r.SSHKey = &sshKeyRecord{
+			Fingerprint: fingerprintSHA256(newKey),
+			Generated:   now,
+			Rotated:     &now,
+			Previous:    previous,
+		}
+		record = r.SSHKey
+	})
+	if err != nil {
+		fail(err)
+		return
+	}
+	journalOperation(ctx, driverName, hostName, journalEntry{Operation: "rotate-key", Phase: phaseEnd})
+	audit.Status = http.StatusOK
+	audit.Detail += " to " + fingerprintSHA256(newKey)
+	publishEvent(event{
+		Type:    "ssh-key-rotated",
+		Driver:  driverName,
+		Name:    hostName,
+		Message: fingerprintSHA256(newKey),
+	})
+	server.Marshal(resp, req, renderKey(newKey, record))
+}
@@ -0,0 +1,77 @@
+package machine
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrBadSelector = errors.New("err-bad-selector")
+)
+
+// Selects machines whose labels have all of the given values.  Written as env=staging,team=ci
+type labelSelector map[string]string
+
+func parseSelector(s string) (labelSelector, error) {
+	selector := labelSelector{}
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		kv := strings.SplitN(term, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, newStatusError(http.StatusBadRequest, ErrBadSelector.Error()+":"+s)
+		}
+		selector[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	if len(selector) == 0 {
+		return nil, newStatusError(http.StatusBadRequest, ErrBadSelector.Error()+":"+s)
+	}
+	return selector, nil
+}
+
+func (s labelSelector) matches(labels map[string]string) bool {
+	for k, v := range s {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s labelSelector) String() string {
+	terms := []string{}
+	for k, v := range s {
+		terms = append(terms, k+"="+v)
+	}
+	return strings.Join(terms, ",")
+}
+
+// A machine by driver and name.
+type machineRef struct {
+	Driver string `json:"driver"`
+	Name   string `json:"name"`
+}
+
+// Finds the machines, not removed, whose labels match the selector.  An empty driver
+// searches the machines of all drivers.
+func selectMachines(ctx context.Context, driverName string, selector labelSelector) []machineRef {
+	selected := []machineRef{}
+	visitMachines(ctx, func(provider, hostName string) {
+		if driverName != "" && provider != driverName {
+			return
+		}
+		record, err := getMachineRecord(ctx, provider, hostName)
+		if err != nil || !selector.matches(record.Labels) {
+			return
+		}
+		if _, removed := getRemovedTime(ctx, provider, hostName); removed {
+			return
+		}
+		selected = append(selected, machineRef{Driver: provider, Name: hostName})
+	})
+	return selected
+}
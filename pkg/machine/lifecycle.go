@@ -0,0 +1,129 @@
+package machine
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Where a machine is in its life, as far as kat-machine is concerned.  Unlike the state
+// reported by the driver, the lifecycle is derived from the journal without calling the provider.
+type Lifecycle string
+
+const (
+	LifecycleNone Lifecycle = "None"
+	Creating      Lifecycle = "Creating"
+	Created       Lifecycle = "Created"
+	Starting      Lifecycle = "Starting"
+	Running       Lifecycle = "Running"
+	Stopping      Lifecycle = "Stopping"
+	Stopped       Lifecycle = "Stopped"
+	Removing      Lifecycle = "Removing"
+	Removed       Lifecycle = "Removed"
+	Failed        Lifecycle = "Failed"
+)
+
+var (
+	ErrInvalidTransition = errors.New("err-invalid-transition")
+
+	// The lifecycle while the operation runs and after it succeeds.  Provisioning follows
+	// create, and the machine is not created until it succeeds.
+	operationLifecycles = map[string][2]Lifecycle{
+		"create":    {Creating, Created},
+		"provision": {Creating, Created},
+		"start":     {Starting, Running},
+		"restart":   {Starting, Running},
+		"stop":      {Stopping, Stopped},
+		"kill":      {Stopping, Stopped},
+		"remove":    {Removing, Removed},
+	}
+
+	// The lifecycles from which an operation is allowed.
+	transitions = map[string][]Lifecycle{
+		"create":  {LifecycleNone, Failed},
+		"start":   {Created, Stopped, Failed},
+		"stop":    {Created, Running, Failed},
+		"restart": {Created, Running, Stopped, Failed},
+		"kill":    {Created, Running, Starting, Stopping, Failed},
+		"remove":  {Created, Running, Stopped, Starting, Stopping, Failed},
+	}
+)
+
+func getLifecycle(ctx context.Context, provider, hostName string) (Lifecycle, error) {
+	entries, err := readJournal(ctx, provider, hostName)
+	if err != nil {
+		return LifecycleNone, err
+	}
+	current := LifecycleNone
+	begun := journalEntry{}
+	for _, entry := range entries {
+		phases, has := operationLifecycles[entry.Operation]
+		if !has {
+			continue
+		}
+		switch {
+		case entry.Phase == phaseBegin:
+			current = phases[0]
+			begun = entry
+		case entry.Phase == phaseAbandoned:
+			// Unless the driver call returns in the background, nothing else will end it.
+			current = Failed
+		case entry.Phase == phaseEnd && entry.Error != "":
+			current = Failed
+		case entry.Phase == phaseEnd:
+			current = phases[1]
+		}
+	}
+	if current == operationLifecycles[begun.Operation][0] && begun.Server != serverRun {
+		// Begun by an earlier run of the server, which stopped before the operation ended.
+		current = Failed
+	}
+	if current == LifecycleNone {
+		// Machines created before the journal was kept only have the log to go by.
+		return getLogLifecycle(ctx, provider, hostName)
+	}
+	return current, nil
+}
+
+func getLogLifecycle(ctx context.Context, provider, hostName string) (Lifecycle, error) {
+	list, err := ioutil.ReadDir(path.Join(machineDir(ctx, provider, hostName), "log"))
+	switch {
+	case os.IsNotExist(err):
+		return LifecycleNone, nil
+	case err != nil:
+		return LifecycleNone, err
+	}
+	if len(list) == 0 {
+		return LifecycleNone, nil
+	}
+	// Log entries are named timestamp-operation.json
+	name := strings.TrimSuffix(list[len(list)-1].Name(), ".json")
+	if i := strings.Index(name, "-"); i > -1 {
+		if phases, has := operationLifecycles[name[i+1:]]; has {
+			return phases[1], nil
+		}
+	}
+	return LifecycleNone, nil
+}
+
+// Checks that the operation is allowed in the current lifecycle of the machine.  The error
+// carries the current lifecycle.
+func checkTransition(ctx context.Context, provider, hostName, op string) (Lifecycle, error) {
+	if err := checkNoOrphan(provider, hostName); err != nil {
+		return LifecycleNone, err
+	}
+	current, err := getLifecycle(ctx, provider, hostName)
+	if err != nil {
+		return current, err
+	}
+	for _, allowed := range transitions[op] {
+		if current == allowed {
+			return current, nil
+		}
+	}
+	return current, newStatusError(http.StatusConflict, ErrInvalidTransition.Error()+":"+op+":"+string(current))
+}
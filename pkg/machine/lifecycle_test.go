@@ -0,0 +1,164 @@
+package machine
+
+import (
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Runs the test in an empty store of its own, which is under the working directory.
+func inTempStore(t *testing.T) func() {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "kat-machine-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func journal(t *testing.T, hostName string, entries ...journalEntry) {
+	start := time.Now()
+	for i, entry := range entries {
+		entry.Time = start.Add(time.Duration(i) * time.Millisecond)
+		if err := writeJournal(context.Background(), "test", hostName, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetLifecycle(t *testing.T) {
+	defer inTempStore(t)()
+
+	for _, c := range []struct {
+		name      string
+		entries   []journalEntry
+		lifecycle Lifecycle
+	}{
+		{"nothing yet", nil, LifecycleNone},
+		{"creating", []journalEntry{
+			{Operation: "create", Phase: phaseBegin},
+		}, Creating},
+		{"created", []journalEntry{
+			{Operation: "create", Phase: phaseBegin},
+			{Operation: "create", Phase: phaseEnd},
+		}, Created},
+		{"provisioning", []journalEntry{
+			{Operation: "create", Phase: phaseBegin},
+			{Operation: "create", Phase: phaseEnd},
+			{Operation: "provision", Phase: phaseBegin},
+		}, Creating},
+		{"provisioning failed", []journalEntry{
+			{Operation: "create", Phase: phaseBegin},
+			{Operation: "create", Phase: phaseEnd},
+			{Operation: "provision", Phase: phaseBegin},
+			{Operation: "provision", Phase: phaseEnd, Error: "err-provision-failed:step-1"},
+		}, Failed},
+		{"stopped", []journalEntry{
+			{Operation: "create", Phase: phaseBegin},
+			{Operation: "create", Phase: phaseEnd},
+			{Operation: "stop", Phase: phaseBegin},
+			{Operation: "stop", Phase: phaseEnd},
+		}, Stopped},
+		{"attempts and state calls do not count", []journalEntry{
+			{Operation: "create", Phase: phaseBegin},
+			{Operation: "create", Attempt: 1, Error: "throttled"},
+			{Operation: "create", Phase: phaseEnd},
+			{Operation: "state", Phase: phaseBegin},
+		}, Created},
+		{"abandoned", []journalEntry{
+			{Operation: "create", Phase: phaseBegin},
+			{Operation: "create", Phase: phaseEnd},
+			{Operation: "start", Phase: phaseBegin},
+			{Operation: "start", Phase: phaseAbandoned, Error: "err-operation-timeout"},
+		}, Failed},
+		{"abandoned and returned later", []journalEntry{
+			{Operation: "start", Phase: phaseBegin},
+			{Operation: "start", Phase: phaseAbandoned, Error: "err-operation-timeout"},
+			{Operation: "start", Phase: phaseEnd, Orphaned: true},
+		}, Running},
+		{"begun by an earlier run of the server", []journalEntry{
+			{Operation: "create", Phase: phaseBegin},
+			{Operation: "create", Phase: phaseEnd},
+			{Operation: "remove", Phase: phaseBegin, Server: "earlier"},
+		}, Failed},
+		{"removed", []journalEntry{
+			{Operation: "remove", Phase: phaseBegin},
+			{Operation: "remove", Phase: phaseEnd},
+		}, Removed},
+	} {
+		journal(t, c.name, c.entries...)
+		lifecycle, err := getLifecycle(context.Background(), "test", c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lifecycle != c.lifecycle {
+			t.Errorf("%s: got %s, want %s", c.name, lifecycle, c.lifecycle)
+		}
+	}
+}
+
+func TestCheckTransition(t *testing.T) {
+	defer inTempStore(t)()
+
+	journal(t, "removed",
+		journalEntry{Operation: "remove", Phase: phaseBegin},
+		journalEntry{Operation: "remove", Phase: phaseEnd})
+	journal(t, "failed",
+		journalEntry{Operation: "stop", Phase: phaseBegin},
+		journalEntry{Operation: "stop", Phase: phaseEnd, Error: "err"})
+	journal(t, "running",
+		journalEntry{Operation: "start", Phase: phaseBegin},
+		journalEntry{Operation: "start", Phase: phaseEnd})
+
+	for _, c := range []struct {
+		hostName string
+		op       string
+		allowed  bool
+	}{
+		{"new", "create", true},
+		{"new", "start", false},
+		{"removed", "start", false},
+		{"removed", "remove", false},
+		{"failed", "remove", true},
+		{"failed", "create", true},
+		{"running", "stop", true},
+		{"running", "create", false},
+		{"running", "start", false},
+	} {
+		_, err := checkTransition(context.Background(), "test", c.hostName, c.op)
+		if (err == nil) != c.allowed {
+			t.Errorf("%s of %s: got %v", c.op, c.hostName, err)
+		}
+		if err != nil && statusOf(err) != 409 {
+			t.Errorf("%s of %s: got status %d", c.op, c.hostName, statusOf(err))
+		}
+	}
+}
+
+func TestOrphanedOperation(t *testing.T) {
+	defer inTempStore(t)()
+
+	journal(t, "busy",
+		journalEntry{Operation: "stop", Phase: phaseBegin},
+		journalEntry{Operation: "stop", Phase: phaseAbandoned, Error: "err-operation-timeout"})
+
+	removeOrphan := addOrphan("test", "busy", "stop")
+	if _, err := checkTransition(context.Background(), "test", "busy", "remove"); err == nil || statusOf(err) != 409 {
+		t.Errorf("remove while the stop has not returned: got %v", err)
+	}
+	removeOrphan()
+	if _, err := checkTransition(context.Background(), "test", "busy", "remove"); err != nil {
+		t.Errorf("remove once the stop returned: got %v", err)
+	}
+}
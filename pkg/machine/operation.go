@@ -0,0 +1,239 @@
+package machine
+
+import (
+	"errors"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOperationTimeout = 10 * time.Minute
+
+	// Auth scope needed to cancel a running operation.
+	OperationScope = "machine-operation"
+)
+
+var (
+	ErrOperationTimeout   = errors.New("err-operation-timeout")
+	ErrOperationCancelled = errors.New("err-operation-cancelled")
+	ErrOperationNotFound  = errors.New("err-operation-not-found")
+	ErrOperationOrphaned  = errors.New("err-operation-orphaned")
+
+	// Deadlines by operation: create, start, stop, restart, kill, remove and state.
+	operationTimeouts     = map[string]time.Duration{}
+	operationTimeoutsLock sync.Mutex
+
+	operations     = map[string]*operation{}
+	operationsLock sync.Mutex
+
+	// The operation of the driver calls that were abandoned and have yet to return, by
+	// provider/name of the machine.
+	orphans     = map[string]string{}
+	orphansLock sync.Mutex
+)
+
+// A driver call made on behalf of a request.  Operations are registered while they run so
+// that they can be listed and cancelled through the api.
+type operation struct {
+	Id        string    `json:"id"`
+	Driver    string    `json:"driver"`
+	Name      string    `json:"name"`
+	Operation string    `json:"operation"`
+	Started   time.Time `json:"started"`
+	Deadline  time.Time `json:"deadline"`
+
+	cancel context.CancelFunc
+}
+
+// Sets the deadlines of driver calls by operation.  Operations not listed or set to zero
+// use DefaultOperationTimeout.
+func SetOperationTimeouts(timeouts map[string]time.Duration) {
+	operationTimeoutsLock.Lock()
+	defer operationTimeoutsLock.Unlock()
+	for k, v := range timeouts {
+		operationTimeouts[k] = v
+	}
+}
+
+func getOperationTimeout(op string) time.Duration {
+	operationTimeoutsLock.Lock()
+	defer operationTimeoutsLock.Unlock()
+	if timeout, has := operationTimeouts[op]; has && timeout > 0 {
+		return timeout
+	}
+	return DefaultOperationTimeout
+}
+
+func registerOperation(o *operation) func() {
+	operationsLock.Lock()
+	defer operationsLock.Unlock()
+	operations[o.Id] = o
+	return func() {
+		operationsLock.Lock()
+		defer operationsLock.Unlock()
+		delete(operations, o.Id)
+	}
+}
+
+// Marks the machine busy with the abandoned operation until the returned function is called.
+func addOrphan(provider, hostName, op string) func() {
+	key := path.Join(provider, hostName)
+	orphansLock.Lock()
+	defer orphansLock.Unlock()
+	orphans[key] = op
+	return func() {
+		orphansLock.Lock()
+		defer orphansLock.Unlock()
+		delete(orphans, key)
+	}
+}
+
+// Fails if a driver call on the machine was abandoned and has yet to return.  Nothing else
+// is done to the machine until it does, so that the call does not run alongside another and
+// its snapshot does not replace a newer one.
+func checkNoOrphan(provider, hostName string) error {
+	orphansLock.Lock()
+	defer orphansLock.Unlock()
+	if op, has := orphans[path.Join(provider, hostName)]; has {
+		return newStatusError(http.StatusConflict, ErrOperationOrphaned.Error()+":"+op)
+	}
+	return nil
+}
+
+// Calls the driver with the deadline configured for the operation.  The driver api has no
+// notion of a context, so a call that misses its deadline or is cancelled cannot be stopped.
+// It is left to finish in the background, and its result is journaled when it does.
+func runOperation(ctx context.Context, provider string, driver drivers.Driver, op, hostName string, call func() error) error {
+	timeout := getOperationTimeout(op)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	o := &operation{
+		Id:        mcnutils.TruncateID(mcnutils.GenerateRandomID()),
+		Driver:    provider,
+		Name:      hostName,
+		Operation: op,
+		Started:   time.Now(),
+		Deadline:  time.Now().Add(timeout),
+		cancel:    cancel,
+	}
+	unregister := registerOperation(o)
+	defer unregister()
+
+	// The begin and end of operations that change the machine are journaled so that the
+	// lifecycle can be derived from the journal.
+	mutating := op != "state"
+	if mutating {
+		journalOperation(ctx, provider, hostName, journalEntry{Operation: op, Phase: phaseBegin})
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- callDriver(ctx, provider, driver, op, hostName, call)
+	}()
+
+	select {
+	case err := <-done:
+		if mutating {
+			journalOperation(ctx, provider, hostName, journalEntry{Operation: op, Phase: phaseEnd, Error: errorString(err)})
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	err := ErrOperationTimeout
+	if ctx.Err() == context.Canceled {
+		err = ErrOperationCancelled
+	}
+	glog.Warningln("Abandoning", op, "of", hostName, "Err=", err)
+
+	journalOperation(ctx, provider, hostName, journalEntry{Operation: op, Phase: phaseAbandoned, Error: err.Error()})
+	setRecordState(ctx, provider, hostName, state.Timeout)
+
+	removeOrphan := func() {}
+	if mutating {
+		removeOrphan = addOrphan(provider, hostName, op)
+	}
+	go func() {
+		defer removeOrphan()
+		orphaned := <-done
+		if orphaned != nil {
+			setRecordState(ctx, provider, hostName, state.Error)
+		} else {
+			setRecordState(ctx, provider, hostName, state.None)
+			if mutating {
+				if err := saveDriver(ctx, provider, driver, op, hostName); err != nil {
+					glog.Warningln("Cannot save driver after", op, "of", hostName, "Err=", err)
+				}
+			}
+		}
+		journalOperation(ctx, provider, hostName,
+			journalEntry{Operation: op, Phase: phaseEnd, Error: errorString(orphaned), Orphaned: true})
+	}()
+	return err
+}
+
+func journalOperation(ctx context.Context, provider, hostName string, entry journalEntry) {
+	if err := writeJournal(ctx, provider, hostName, entry); err != nil {
+		glog.Warningln("Cannot journal", entry.Operation, "of", hostName, "Err=", err)
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Remembers the state last seen for the machine in its record.  state.None clears it.
+func setRecordState(ctx context.Context, provider, hostName string, s state.State) {
+	err := updateMachineRecord(ctx, provider, hostName, func(record *machineRecord) {
+		record.State = s.String()
+	})
+	if err != nil {
+		glog.Warningln("Cannot update record of", hostName, "Err=", err)
+	}
+}
+
+func ListOperations(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	operationsLock.Lock()
+	list := []*operation{}
+	for _, o := range operations {
+		list = append(list, o)
+	}
+	operationsLock.Unlock()
+
+	sort.Sort(operationsByStart(list))
+	server.Marshal(resp, req, list)
+}
+
+func CancelOperation(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	id := server.GetUrlParameter(req, "id")
+
+	operationsLock.Lock()
+	o, has := operations[id]
+	operationsLock.Unlock()
+
+	if !has {
+		server.HandleError(ctx, http.StatusNotFound, ErrOperationNotFound.Error()+":"+id)
+		return
+	}
+	o.cancel()
+	server.Marshal(resp, req, o)
+}
+
+type operationsByStart []*operation
+
+func (l operationsByStart) Len() int           { return len(l) }
+func (l operationsByStart) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l operationsByStart) Less(i, j int) bool { return l[i].Started.Before(l[j].Started) }
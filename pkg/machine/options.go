@@ -0,0 +1,52 @@
+package machine
+
+import (
+	"encoding/json"
+	"github.com/conductant/kat-machine/pkg/provision"
+	"time"
+)
+
+// Fields of the create payload that are kat-machine's own rather than flags of the driver.
+type createOptions struct {
+	Protected bool              `json:"protected,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+
+	// Either a ttl, such as 72h, or the time the machine expires.
+	TTL          string     `json:"ttl,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	ExpiryAction string     `json:"expiry_action,omitempty"`
+
+	// Steps run over ssh once the machine is created.
+	Provision []provisionStep `json:"provision,omitempty"`
+
+	// Installs the Docker engine with TLS, ahead of the provisioning steps.
+	Engine *provision.EngineOptions `json:"engine,omitempty"`
+
+	// The swarm cluster the machine joins once created, which needs the engine.
+	Cluster string `json:"cluster,omitempty"`
+
+	// Http and tcp probes checked with the health of the machine.
+	Health []healthProbe `json:"health,omitempty"`
+}
+
+var (
+	createOptionKeys = []string{"protected", "labels", "ttl", "expires_at", "expiry_action", "provision", "engine", "cluster", "health"}
+)
+
+// Takes the kat-machine fields out of the input so that only driver flags are left.
+func takeCreateOptions(input jsonFlags) (createOptions, error) {
+	options := createOptions{}
+	fields := map[string]interface{}{}
+	for _, key := range createOptionKeys {
+		if v, has := input[key]; has {
+			fields[key] = v
+			delete(input, key)
+		}
+	}
+	buff, err := json.Marshal(fields)
+	if err != nil {
+		return options, err
+	}
+	err = json.Unmarshal(buff, &options)
+	return options, err
+}
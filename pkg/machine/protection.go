@@ -0,0 +1,87 @@
+package machine
+
+import (
+	"errors"
+	"github.com/conductant/gohm/pkg/server"
+	"golang.org/x/net/context"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// Auth scope needed to set or clear the deletion protection of a machine.
+	ProtectScope = "machine-protect"
+)
+
+var (
+	ErrForbidden = errors.New("err-forbidden")
+	ErrProtected = errors.New("err-protected")
+
+	// Set when the server has no public key to verify tokens with, as in dev.
+	authDisabled bool
+)
+
+// Turns off the checks of scopes made by handlers, as the routes are not checked either.
+func SetAuthDisabled(disabled bool) {
+	authDisabled = disabled
+}
+
+// Tells if the auth token of the request carries the scope.  Every scope is granted when auth
+// is disabled, the same as gohm does for the scopes of routes.
+func hasScope(ctx context.Context, scope string) bool {
+	return authDisabled || ctx.Value(scope) != nil
+}
+
+// Checks that the machine is not protected from remove and kill.
+func checkUnprotected(ctx context.Context, provider, hostName string) error {
+	record, err := getMachineRecord(ctx, provider, hostName)
+	if err != nil {
+		return err
+	}
+	if record.Protected {
+		return newStatusError(http.StatusLocked, ErrProtected.Error()+":"+hostName)
+	}
+	return nil
+}
+
+func SetProtection(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+	protected, err := strconv.ParseBool(server.GetUrlParameter(req, "protected"))
+	if err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	unlock := lockMachine(driverName, hostName)
+	defer unlock()
+
+	if lifecycle, err := getLifecycle(ctx, driverName, hostName); err != nil || lifecycle == LifecycleNone {
+		server.HandleError(ctx, http.StatusNotFound, "err-not-found:"+hostName)
+		return
+	}
+
+	err = updateMachineRecord(ctx, driverName, hostName, func(record *machineRecord) {
+		record.Protected = protected
+	})
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	op := "unprotect"
+	if protected {
+		op = "protect"
+	}
+	err = writeJournal(ctx, driverName, hostName, journalEntry{Operation: op})
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	result := map[string]interface{}{
+		"name":      hostName,
+		"protected": protected,
+	}
+	server.Marshal(resp, req, result)
+}
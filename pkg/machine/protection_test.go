@@ -0,0 +1,29 @@
+package machine
+
+import (
+	"golang.org/x/net/context"
+	"testing"
+)
+
+func TestHasScope(t *testing.T) {
+	defer SetAuthDisabled(false)
+
+	token := context.WithValue(context.Background(), ProtectScope, true)
+	for _, c := range []struct {
+		name     string
+		disabled bool
+		ctx      context.Context
+		scope    string
+		granted  bool
+	}{
+		{"scope in the token", false, token, ProtectScope, true},
+		{"scope not in the token", false, token, KeyScope, false},
+		{"no token", false, context.Background(), ProtectScope, false},
+		{"auth disabled", true, context.Background(), ProtectScope, true},
+	} {
+		SetAuthDisabled(c.disabled)
+		if granted := hasScope(c.ctx, c.scope); granted != c.granted {
+			t.Errorf("%s: got %v, want %v", c.name, granted, c.granted)
+		}
+	}
+}
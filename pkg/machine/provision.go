@@ -0,0 +1,312 @@
+package machine
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Output kept per step.  Longer output keeps its tail, where the errors usually are.
+	MaxProvisionOutput = 64 * 1024
+
+	DefaultProvisionStepTimeout = 30 * time.Minute
+)
+
+var (
+	ErrBadProvisionStep = errors.New("err-bad-provision-step")
+	ErrProvisionFailed  = errors.New("err-provision-failed")
+	ErrSSHUnavailable   = errors.New("err-ssh-unavailable")
+
+	provisionStepTimeout     = DefaultProvisionStepTimeout
+	provisionStepTimeoutLock sync.Mutex
+)
+
+// A step run over ssh once the machine is created.  A step is one of a shell script, a file
+// to write or a subset of cloud-config, which is expanded into scripts and files.
+type provisionStep struct {
+	Name        string         `json:"name,omitempty"`
+	Script      string         `json:"script,omitempty"`
+	File        *provisionFile `json:"file,omitempty"`
+	CloudConfig *cloudConfig   `json:"cloud_config,omitempty"`
+
+	// Runs the step as root.  Cloud-config always runs as root.
+	Sudo bool `json:"sudo,omitempty"`
+
+	// A failing step fails the create unless it is allowed to continue.
+	ContinueOnError bool `json:"continue_on_error,omitempty"`
+
+	// Deadline of the step, e.g. 10m, instead of the server's.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// A file to write.  The fields are those of write_files in cloud-config.
+type provisionFile struct {
+	Path        string `json:"path"`
+	Content     string `json:"content,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+}
+
+// The part of cloud-config that is supported.  Commands in runcmd are either a string for the
+// shell or a list of arguments.
+type cloudConfig struct {
+	Packages   []string        `json:"packages,omitempty"`
+	WriteFiles []provisionFile `json:"write_files,omitempty"`
+	RunCmd     []interface{}   `json:"runcmd,omitempty"`
+}
+
+// How a step went.  The exit status is -1 when the step did not get to run.
+type provisionResult struct {
+	Step       string    `json:"step"`
+	Started    time.Time `json:"started"`
+	Duration   string    `json:"duration"`
+	ExitStatus int       `json:"exit_status"`
+	Output     string    `json:"output,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Sets the deadline of provisioning steps that do not have their own.  Zero is
+// DefaultProvisionStepTimeout.
+func SetProvisionStepTimeout(timeout time.Duration) {
+	provisionStepTimeoutLock.Lock()
+	defer provisionStepTimeoutLock.Unlock()
+	if timeout <= 0 {
+		timeout = DefaultProvisionStepTimeout
+	}
+	provisionStepTimeout = timeout
+}
+
+func (s provisionStep) timeout() time.Duration {
+	if d, err := time.ParseDuration(s.Timeout); err == nil && d > 0 {
+		return d
+	}
+	provisionStepTimeoutLock.Lock()
+	defer provisionStepTimeoutLock.Unlock()
+	return provisionStepTimeout
+}
+
+// Expands cloud-config and checks the steps.  Each step returned has a name and is either a
+// script or a file.
+func expandSteps(steps []provisionStep) ([]provisionStep, error) {
+	expanded := []provisionStep{}
+	for i, step := range steps {
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step-%d", i+1)
+		}
+		kinds := 0
+		for _, set := range []bool{step.Script != "", step.File != nil, step.CloudConfig != nil} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return nil, newStatusError(http.StatusBadRequest, ErrBadProvisionStep.Error()+":"+step.Name)
+		}
+		if step.Timeout != "" {
+			if d, err := time.ParseDuration(step.Timeout); err != nil || d <= 0 {
+				return nil, newStatusError(http.StatusBadRequest, ErrBadProvisionStep.Error()+":"+step.Name+":bad-timeout")
+			}
+		}
+		switch {
+		case step.File != nil:
+			if err := step.File.validate(); err != nil {
+				return nil, newStatusError(http.StatusBadRequest, ErrBadProvisionStep.Error()+":"+step.Name+":"+err.Error())
+			}
+			expanded = append(expanded, step)
+		case step.CloudConfig != nil:
+			more, err := step.CloudConfig.expand(step)
+			if err != nil {
+				return nil, newStatusError(http.StatusBadRequest, ErrBadProvisionStep.Error()+":"+step.Name+":"+err.Error())
+			}
+			expanded = append(expanded, more...)
+		default:
+			expanded = append(expanded, step)
+		}
+	}
+	return expanded, nil
+}
+
+func (f *provisionFile) validate() error {
+	if f.Path == "" {
+		return errors.New("no-path")
+	}
+	switch f.Encoding {
+	case "", "text/plain":
+	case "b64", "base64":
+		if _, err := base64.StdEncoding.DecodeString(f.Content); err != nil {
+			return errors.New("bad-content")
+		}
+	default:
+		return errors.New("bad-encoding:" + f.Encoding)
+	}
+	if f.Permissions != "" {
+		if _, err := strconv.ParseUint(f.Permissions, 8, 32); err != nil {
+			return errors.New("bad-permissions:" + f.Permissions)
+		}
+	}
+	return nil
+}
+
+// Turns cloud-config into steps in the order cloud-init would run them: packages, files and
+// then commands.
+func (c *cloudConfig) expand(parent provisionStep) ([]provisionStep, error) {
+	steps := []provisionStep{}
+	step := func(suffix string) provisionStep {
+		return provisionStep{Name: parent.Name + ":" + suffix, Sudo: true, ContinueOnError: parent.ContinueOnError,
+			Timeout: parent.Timeout}
+	}
+	if len(c.Packages) > 0 {
+		packages := []string{}
+		for _, p := range c.Packages {
+			packages = append(packages, shellQuote(p))
+		}
+		list := strings.Join(packages, " ")
+		s := step("packages")
+		s.Script = "if command -v apt-get >/dev/null; then\n" +
+			"  export DEBIAN_FRONTEND=noninteractive\n" +
+			"  apt-get update && apt-get install -y " + list + "\n" +
+			"elif command -v yum >/dev/null; then\n" +
+			"  yum install -y " + list + "\n" +
+			"else\n" +
+			"  echo 'no supported package manager' >&2; exit 1\n" +
+			"fi\n"
+		steps = append(steps, s)
+	}
+	for i := range c.WriteFiles {
+		f := c.WriteFiles[i]
+		if err := f.validate(); err != nil {
+			return nil, err
+		}
+		s := step("write_files:" + f.Path)
+		s.File = &f
+		steps = append(steps, s)
+	}
+	for i, cmd := range c.RunCmd {
+		s := step(fmt.Sprintf("runcmd-%d", i+1))
+		switch cmd := cmd.(type) {
+		case string:
+			s.Script = cmd
+		case []interface{}:
+			args := []string{}
+			for _, arg := range cmd {
+				args = append(args, shellQuote(fmt.Sprint(arg)))
+			}
+			s.Script = strings.Join(args, " ")
+		default:
+			return nil, errors.New("bad-runcmd")
+		}
+		steps = append(steps, s)
+	}
+	return steps, nil
+}
+
+// The shell command for the step.  The script or the content of the file is read from stdin,
+// so that it is not on the command line where other users of the machine could see it.
+func (s provisionStep) command() string {
+	sudo := ""
+	if s.Sudo {
+		sudo = "sudo "
+	}
+	if s.File == nil {
+		// Saved first, so that commands of the script that read stdin do not read the rest of it.
+		return `f=$(mktemp) && cat >"$f" && ` + sudo + `sh "$f" </dev/null; status=$?; rm -f "$f"; exit $status`
+	}
+	p := shellQuote(s.File.Path)
+	permissions := s.File.Permissions
+	if permissions == "" {
+		permissions = "0644"
+	}
+	// Written readable by the owner only until the permissions are set, as keys are.
+	cmd := sudo + "mkdir -p \"$(dirname " + p + ")\" && umask 077 && " + sudo + "tee " + p + " >/dev/null && " +
+		sudo + "chmod " + permissions + " " + p
+	if s.File.Owner != "" {
+		cmd += " && " + sudo + "chown " + shellQuote(s.File.Owner) + " " + p
+	}
+	return cmd
+}
+
+// What the command of the step reads from stdin: the script or the decoded content of the file.
+func (s provisionStep) stdin() []byte {
+	if s.File == nil {
+		return []byte(s.Script)
+	}
+	if s.File.Encoding == "b64" || s.File.Encoding == "base64" {
+		content, _ := base64.StdEncoding.DecodeString(s.File.Content)
+		return content
+	}
+	return []byte(s.File.Content)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Runs the step and reads back its output and exit status.
+func runStep(driver drivers.Driver, step provisionStep) provisionResult {
+	result := provisionResult{Step: step.Name, Started: time.Now(), ExitStatus: -1}
+	output, status, err := runSSHCommand(driver, step.command(), step.stdin(), step.timeout())
+	result.Duration = time.Since(result.Started).String()
+	if len(output) > MaxProvisionOutput {
+		output = output[len(output)-MaxProvisionOutput:]
+	}
+	result.Output = string(output)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.ExitStatus = status
+	if status != 0 {
+		result.Error = fmt.Sprintf("exit status %d", status)
+	}
+	return result
+}
+
+// Runs the steps once the machine answers on ssh.  Each step is journaled and the results
+// are kept in the record.  The first failing step that may not continue stops the rest and
+// fails the provisioning.
+func runProvisioning(ctx context.Context, provider string, driver drivers.Driver, hostName string, steps []provisionStep) ([]provisionResult, error) {
+	journalOperation(ctx, provider, hostName, journalEntry{Operation: "provision", Phase: phaseBegin})
+
+	results := []provisionResult{}
+	var failed error
+	if err := drivers.WaitForSSH(driver); err != nil {
+		failed = newStatusError(http.StatusGatewayTimeout, ErrSSHUnavailable.Error()+":"+hostName)
+	}
+	for _, step := range steps {
+		if failed != nil {
+			break
+		}
+		result := runStep(driver, step)
+		results = append(results, result)
+		entry := journalEntry{Operation: "provision"}
+		if result.Error != "" {
+			entry.Error = step.Name + ":" + result.Error
+		}
+		journalOperation(ctx, provider, hostName, entry)
+		if result.Error != "" {
+			glog.Warningln("Provisioning step", step.Name, "of", hostName, "failed. Err=", result.Error)
+			if !step.ContinueOnError {
+				failed = newStatusError(http.StatusInternalServerError, ErrProvisionFailed.Error()+":"+step.Name)
+			}
+		}
+	}
+
+	journalOperation(ctx, provider, hostName, journalEntry{Operation: "provision", Phase: phaseEnd, Error: errorString(failed)})
+	err := updateMachineRecord(ctx, provider, hostName, func(record *machineRecord) {
+		record.Provision = results
+	})
+	if err != nil {
+		glog.Warningln("Cannot record provisioning of", hostName, "Err=", err)
+	}
+	return results, failed
+}
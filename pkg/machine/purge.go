@@ -0,0 +1,97 @@
+package machine
+
+import (
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRemovedRetention = 7 * 24 * time.Hour
+	DefaultPurgeInterval    = 1 * time.Hour
+)
+
+// Tells when the machine was removed.  Machines removed before tombstones were recorded use
+// the time of the last log entry.
+func getRemovedTime(ctx context.Context, provider, hostName string) (time.Time, bool) {
+	record, err := getMachineRecord(ctx, provider, hostName)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if record.Removed != nil {
+		return *record.Removed, true
+	}
+	if lifecycle, err := getLifecycle(ctx, provider, hostName); err != nil || lifecycle != Removed {
+		return time.Time{}, false
+	}
+	list, err := ioutil.ReadDir(path.Join(machineDir(ctx, provider, hostName), "log"))
+	if err != nil || len(list) == 0 {
+		return time.Time{}, false
+	}
+	return list[len(list)-1].ModTime(), true
+}
+
+// Deletes the tombstones of machines removed longer than the retention ago, together with
+// the local artifacts the driver kept for them under its store path.
+func purgeRemoved(ctx context.Context, retention time.Duration) {
+	visitMachines(ctx, func(provider, hostName string) {
+		removed, ok := getRemovedTime(ctx, provider, hostName)
+		if !ok || time.Since(removed) < retention {
+			return
+		}
+		if err := purgeMachine(ctx, provider, hostName); err != nil {
+			glog.Warningln("Cannot purge", provider, hostName, "Err=", err)
+			return
+		}
+		glog.Infoln("Purged", provider, hostName, "removed at", removed)
+	})
+}
+
+func purgeMachine(ctx context.Context, provider, hostName string) error {
+	unlock := lockMachine(provider, hostName)
+	defer unlock()
+
+	storePath := getStorePath(ctx, provider)
+
+	// Keys are normally in the machine directory, but the driver may have been pointed
+	// elsewhere in its store.
+	if driver, restored, err := getDriver(ctx, provider, hostName); err == nil && restored {
+		if key := driver.GetSSHKeyPath(); key != "" && strings.HasPrefix(key, storePath+"/") {
+			for _, p := range []string{key, key + ".pub"} {
+				if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+	return os.RemoveAll(path.Join(storePath, "machines", hostName))
+}
+
+// Starts the job that purges removed machines once their retention has passed.  Returns the
+// function that stops the job.
+func StartPurge(retention, interval time.Duration) func() {
+	if retention <= 0 {
+		retention = DefaultRemovedRetention
+	}
+	if interval <= 0 {
+		interval = DefaultPurgeInterval
+	}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			purgeRemoved(context.Background(), retention)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
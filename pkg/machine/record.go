@@ -0,0 +1,148 @@
+package machine
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// The record is what kat-machine itself knows about a machine, as opposed to the state of
+// the driver which is kept in the log.  It is stored next to the log in the machine directory.
+type machineRecord struct {
+	Driver string        `json:"driver"`
+	Name   string        `json:"name"`
+	Create *createRecord `json:"create,omitempty"`
+
+	// The state last seen by the server.  This is also where an operation that timed out
+	// leaves state.Timeout until the driver call eventually returns.
+	State string `json:"state,omitempty"`
+
+	// Protected machines cannot be removed or killed until the protection is cleared.
+	Protected bool `json:"protected,omitempty"`
+
+	// Labels given at create, used to select machines for bulk operations.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Machines with an expiry are stopped or removed by the reaper when it passes.
+	Expiry *expiryRecord `json:"expiry,omitempty"`
+
+	// The template version the machine was created from.
+	Template *templateRef `json:"template,omitempty"`
+
+	// The machine this one was cloned from.
+	CloneOf *machineRef `json:"clone_of,omitempty"`
+
+	// The results of the provisioning steps run after create.
+	Provision []provisionResult `json:"provision,omitempty"`
+
+	// The Docker engine installed at create.
+	Engine *engineRecord `json:"engine,omitempty"`
+
+	// The ssh key of the machine, when kat-machine looks after it.
+	SSHKey *sshKeyRecord `json:"ssh_key,omitempty"`
+
+	// The client certificates issued for the engine of the machine that have not expired.
+	ClientCerts []clientCertRecord `json:"client_certs,omitempty"`
+
+	// The swarm cluster the machine is in.
+	Cluster *clusterRole `json:"cluster,omitempty"`
+
+	// The probes of the machine and the results of its health checks.
+	Health *healthRecord `json:"health,omitempty"`
+
+	// Tombstone of a removed machine.  The record is purged after the retention period.
+	Removed *time.Time `json:"removed,omitempty"`
+}
+
+// Remembers the create request that produced the machine so that repeats can be answered
+// without calling the provider again.
+type createRecord struct {
+	IdempotencyKey string                 `json:"idempotency_key,omitempty"`
+	Digest         string                 `json:"digest"`
+	Result         map[string]interface{} `json:"result"`
+
+	// The error of the provisioning, when the machine was created but not provisioned.
+	Failed string `json:"failed,omitempty"`
+}
+
+var (
+	machineLocks     = map[string]*sync.Mutex{}
+	machineLocksLock sync.Mutex
+
+	recordsLock sync.Mutex
+)
+
+// Serializes operations on a single machine.  Returns the function that releases the lock.
+func lockMachine(provider, hostName string) func() {
+	key := path.Join(provider, hostName)
+	machineLocksLock.Lock()
+	lock, has := machineLocks[key]
+	if !has {
+		lock = &sync.Mutex{}
+		machineLocks[key] = lock
+	}
+	machineLocksLock.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+func getMachineRecordPath(ctx context.Context, provider, hostName string) string {
+	return path.Join(getMachinePath(ctx, provider, hostName), "record.json")
+}
+
+func getMachineRecord(ctx context.Context, provider, hostName string) (*machineRecord, error) {
+	record := &machineRecord{Driver: provider, Name: hostName}
+	buff, err := ioutil.ReadFile(path.Join(machineDir(ctx, provider, hostName), "record.json"))
+	switch {
+	case os.IsNotExist(err):
+		return record, nil
+	case err != nil:
+		return nil, err
+	}
+	err = json.Unmarshal(buff, record)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func saveMachineRecord(ctx context.Context, record *machineRecord) error {
+	buff, err := json.MarshalIndent(record, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(getMachineRecordPath(ctx, record.Driver, record.Name), buff, 0644)
+}
+
+// Reads, changes and saves the record of a machine in one step.  Unlike lockMachine, this
+// is never held while calling a driver.
+func updateMachineRecord(ctx context.Context, provider, hostName string, update func(*machineRecord)) error {
+	recordsLock.Lock()
+	defer recordsLock.Unlock()
+
+	record, err := getMachineRecord(ctx, provider, hostName)
+	if err != nil {
+		return err
+	}
+	update(record)
+	return saveMachineRecord(ctx, record)
+}
+
+// Computes a digest of the request payload.  JSON payloads are re-encoded first so that
+// differences in whitespace or key order do not count as a different payload.
+func payloadDigest(payload []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err == nil {
+		if canonical, err := json.Marshal(v); err == nil {
+			payload = canonical
+		}
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(payload))
+}
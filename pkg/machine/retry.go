@@ -0,0 +1,226 @@
+package machine
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/cenkalti/backoff"
+	"github.com/digitalocean/godo"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits of the exponential backoff used when retrying a driver call that failed with a
+// retryable error.  Zero values fall back to the defaults of the backoff package.
+type RetryPolicy struct {
+	InitialInterval time.Duration `json:"initial_interval,omitempty" yaml:"initial_interval"`
+	MaxInterval     time.Duration `json:"max_interval,omitempty" yaml:"max_interval"`
+	Multiplier      float64       `json:"multiplier,omitempty" yaml:"multiplier"`
+	MaxElapsedTime  time.Duration `json:"max_elapsed_time,omitempty" yaml:"max_elapsed_time"`
+	MaxAttempts     int           `json:"max_attempts,omitempty" yaml:"max_attempts"`
+}
+
+const (
+	// Key of the policy that applies to drivers without a policy of their own.
+	DefaultRetryPolicyKey = "default"
+)
+
+var (
+	retryPolicies = map[string]RetryPolicy{
+		DefaultRetryPolicyKey: RetryPolicy{
+			InitialInterval: 1 * time.Second,
+			MaxInterval:     30 * time.Second,
+			MaxElapsedTime:  5 * time.Minute,
+			MaxAttempts:     5,
+		},
+	}
+	retryPoliciesLock sync.Mutex
+
+	// Per driver classification of errors.  Drivers not listed here, and errors the driver
+	// specific check does not recognize, use classifyDefault.
+	errorClassifiers = map[string]func(error) (class errorClass, known bool){
+		"amazonec2":    classifyAws,
+		"digitalocean": classifyDigitalOcean,
+		"google":       classifyGoogle,
+	}
+
+	// Operations that can be repeated after a call that may have gone through.  A create
+	// that timed out may have made the instance, and repeating it would make another.
+	idempotentOperations = map[string]bool{
+		"state":   true,
+		"start":   true,
+		"stop":    true,
+		"restart": true,
+		"kill":    true,
+	}
+)
+
+type errorClass int
+
+const (
+	errorTerminal errorClass = iota
+
+	// The provider turned the call away, as when throttling, so it had no effect.
+	errorRefused
+
+	// The call failed in a way that leaves it unknown whether it had an effect, such as a
+	// timeout or a server side error.
+	errorAmbiguous
+)
+
+// Sets the retry policies by driver name.  Use DefaultRetryPolicyKey for the policy of the
+// drivers that are not listed.
+func SetRetryPolicies(policies map[string]RetryPolicy) {
+	retryPoliciesLock.Lock()
+	defer retryPoliciesLock.Unlock()
+	for k, v := range policies {
+		retryPolicies[k] = v
+	}
+}
+
+func getRetryPolicy(provider string) RetryPolicy {
+	retryPoliciesLock.Lock()
+	defer retryPoliciesLock.Unlock()
+	if policy, has := retryPolicies[provider]; has {
+		return policy
+	}
+	return retryPolicies[DefaultRetryPolicyKey]
+}
+
+func (p RetryPolicy) backOff() backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	if p.InitialInterval > 0 {
+		b.InitialInterval = p.InitialInterval
+	}
+	if p.MaxInterval > 0 {
+		b.MaxInterval = p.MaxInterval
+	}
+	if p.Multiplier > 0 {
+		b.Multiplier = p.Multiplier
+	}
+	if p.MaxElapsedTime > 0 {
+		b.MaxElapsedTime = p.MaxElapsedTime
+	}
+	b.Reset()
+	return b
+}
+
+func classifyError(provider string, err error) errorClass {
+	if classify, has := errorClassifiers[provider]; has {
+		if class, known := classify(err); known {
+			return class
+		}
+	}
+	return classifyDefault(err)
+}
+
+// Tells whether the operation is retried after an error of the class.
+func isRetryable(operation string, class errorClass) bool {
+	return class == errorRefused || (class == errorAmbiguous && idempotentOperations[operation])
+}
+
+func classifyStatus(code int) errorClass {
+	switch {
+	case code == 429:
+		return errorRefused
+	case code >= 500:
+		return errorAmbiguous
+	}
+	return errorTerminal
+}
+
+// Throttling comes back with a status of 400, so the code is looked at before the status.
+func classifyAws(err error) (errorClass, bool) {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "Throttling", "ThrottlingException", "RequestLimitExceeded":
+			return errorRefused, true
+		case "InternalError", "Unavailable", "RequestTimeout":
+			return errorAmbiguous, true
+		}
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return classifyStatus(reqErr.StatusCode()), true
+	}
+	return errorTerminal, false
+}
+
+func classifyDigitalOcean(err error) (errorClass, bool) {
+	if doErr, ok := err.(*godo.ErrorResponse); ok && doErr.Response != nil {
+		return classifyStatus(doErr.Response.StatusCode), true
+	}
+	return errorTerminal, false
+}
+
+func classifyGoogle(err error) (errorClass, bool) {
+	if gErr, ok := err.(*googleapi.Error); ok {
+		return classifyStatus(gErr.Code), true
+	}
+	return errorTerminal, false
+}
+
+// Default classification for errors that carry no structured information: messages that
+// look like throttling are refused calls, and network timeouts and messages that look like
+// server side failures are ambiguous.
+func classifyDefault(err error) errorClass {
+	message := strings.ToLower(err.Error())
+	for _, s := range []string{"throttl", "rate limit", "too many requests"} {
+		if strings.Contains(message, s) {
+			return errorRefused
+		}
+	}
+	if netErr, ok := err.(net.Error); ok && (netErr.Timeout() || netErr.Temporary()) {
+		return errorAmbiguous
+	}
+	for _, s := range []string{
+		"timeout", "timed out", "temporarily unavailable", "internal server error", "bad gateway",
+		"service unavailable", "gateway timeout", "connection reset",
+	} {
+		if strings.Contains(message, s) {
+			return errorAmbiguous
+		}
+	}
+	return errorTerminal
+}
+
+// Calls the driver, retrying according to the policy of the driver for as long as the errors
+// are retryable for the operation.  Every attempt is journaled.
+func callDriver(ctx context.Context, provider string, driver drivers.Driver, operation, hostName string, call func() error) error {
+	driverName := driver.DriverName()
+	policy := getRetryPolicy(driverName)
+	b := policy.backOff()
+	for attempt := 1; ; attempt++ {
+		err := call()
+
+		entry := journalEntry{Operation: operation, Attempt: attempt}
+		if err != nil {
+			entry.Error = err.Error()
+			entry.Retryable = isRetryable(operation, classifyError(driverName, err))
+		}
+		// State reads are frequent and change nothing, so only their failures are journaled.
+		if err != nil || operation != "state" {
+			journalOperation(ctx, provider, hostName, entry)
+		}
+
+		if err == nil || !entry.Retryable {
+			return err
+		}
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return err
+		}
+		wait := b.NextBackOff()
+		if wait == backoff.Stop {
+			return err
+		}
+		glog.Infoln("Retrying", operation, "of", hostName, "in", wait, "Err=", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package machine
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/digitalocean/godo"
+	"google.golang.org/api/googleapi"
+	"net/http"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return false }
+
+func TestClassifyError(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		provider string
+		err      error
+		class    errorClass
+	}{
+		{"aws throttling with 400", "amazonec2",
+			awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), 400, "r"), errorRefused},
+		{"aws limit exceeded", "amazonec2",
+			awserr.New("RequestLimitExceeded", "slow down", nil), errorRefused},
+		{"aws internal error", "amazonec2",
+			awserr.NewRequestFailure(awserr.New("InternalError", "oops", nil), 500, "r"), errorAmbiguous},
+		{"aws 503 without a known code", "amazonec2",
+			awserr.NewRequestFailure(awserr.New("Whatever", "oops", nil), 503, "r"), errorAmbiguous},
+		{"aws bad parameter", "amazonec2",
+			awserr.NewRequestFailure(awserr.New("InvalidParameterValue", "no", nil), 400, "r"), errorTerminal},
+		{"digitalocean 429", "digitalocean",
+			&godo.ErrorResponse{Response: &http.Response{StatusCode: 429}}, errorRefused},
+		{"digitalocean 502", "digitalocean",
+			&godo.ErrorResponse{Response: &http.Response{StatusCode: 502}}, errorAmbiguous},
+		{"digitalocean 422", "digitalocean",
+			&godo.ErrorResponse{Response: &http.Response{StatusCode: 422}}, errorTerminal},
+		{"google 429", "google", &googleapi.Error{Code: 429}, errorRefused},
+		{"google 404", "google", &googleapi.Error{Code: 404}, errorTerminal},
+		{"message that looks like throttling", "virtualbox", errors.New("Too Many Requests"), errorRefused},
+		{"message that looks like a server error", "virtualbox", errors.New("502 Bad Gateway"), errorAmbiguous},
+		{"network timeout", "virtualbox", timeoutError{}, errorAmbiguous},
+		{"anything else", "virtualbox", errors.New("no such image"), errorTerminal},
+		{"unstructured error of a listed driver", "amazonec2", errors.New("connection reset by peer"), errorAmbiguous},
+	} {
+		if class := classifyError(c.provider, c.err); class != c.class {
+			t.Errorf("%s: got %d, want %d", c.name, class, c.class)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, c := range []struct {
+		operation string
+		class     errorClass
+		retryable bool
+	}{
+		{"create", errorRefused, true},
+		{"create", errorAmbiguous, false},
+		{"remove", errorAmbiguous, false},
+		{"remove", errorRefused, true},
+		{"stop", errorAmbiguous, true},
+		{"state", errorAmbiguous, true},
+		{"start", errorTerminal, false},
+	} {
+		if retryable := isRetryable(c.operation, c.class); retryable != c.retryable {
+			t.Errorf("%s after %d: got %v, want %v", c.operation, c.class, retryable, c.retryable)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package machine
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultScheduleInterval = 30 * time.Second
+
+	// Auth scope needed to create or remove a schedule.
+	ScheduleScope = "machine-schedule"
+)
+
+var (
+	ErrScheduleNotFound = errors.New("err-schedule-not-found")
+	ErrBadSchedule      = errors.New("err-bad-schedule")
+
+	schedulesLock sync.Mutex
+)
+
+// A power action run on a cron schedule, against one machine or the machines matching a
+// label selector.  Schedules are kept in the store, one file each.
+type schedule struct {
+	Id       string `json:"id"`
+	Cron     string `json:"cron"`
+	Action   string `json:"action"`
+	Timezone string `json:"timezone,omitempty"`
+
+	// Either a machine, by driver and name, or a selector, optionally limited to a driver.
+	Driver   string `json:"driver,omitempty"`
+	Machine  string `json:"machine,omitempty"`
+	Selector string `json:"selector,omitempty"`
+
+	Created time.Time    `json:"created"`
+	LastRun *scheduleRun `json:"last_run,omitempty"`
+
+	// Computed when the schedule is read.
+	NextRun *time.Time `json:"next_run,omitempty"`
+}
+
+// What happened the last time a schedule ran.  Runs missed while the server was down are
+// caught up once, with the latest of them, when it starts again.
+type scheduleRun struct {
+	Scheduled time.Time     `json:"scheduled"`
+	Started   time.Time     `json:"started"`
+	CaughtUp  bool          `json:"caught_up,omitempty"`
+	Bulk      string        `json:"bulk"`
+	Status    string        `json:"status"`
+	Results   []*bulkResult `json:"results"`
+}
+
+func getSchedulesPath(ctx context.Context) string {
+	p := path.Join(getStoreRoot(ctx), "schedules")
+	err := os.MkdirAll(p, 0755)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (s *schedule) location() (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(s.Timezone)
+}
+
+func (s *schedule) validate() error {
+	bad := func(reason string) error {
+		return newStatusError(http.StatusBadRequest, ErrBadSchedule.Error()+":"+reason)
+	}
+	if _, err := parseCron(s.Cron); err != nil {
+		return newStatusError(http.StatusBadRequest, err.Error())
+	}
+	if err := checkAction(s.Action); err != nil {
+		return err
+	}
+	if _, err := s.location(); err != nil {
+		return bad(s.Timezone)
+	}
+	switch {
+	case s.Machine != "" && s.Selector != "":
+		return bad("machine-and-selector")
+	case s.Machine != "" && s.Driver == "":
+		return bad("machine-without-driver")
+	case s.Machine == "" && s.Selector == "":
+		return bad("no-machine-or-selector")
+	case s.Selector != "":
+		if _, err := parseSelector(s.Selector); err != nil {
+			return err
+		}
+	}
+	if s.Driver != "" && !isProvider(s.Driver) {
+		return newStatusError(http.StatusNotFound, "err-not-found:"+s.Driver)
+	}
+	return nil
+}
+
+// The next run after the last one, or after the schedule was created.
+func (s *schedule) next() time.Time {
+	spec, err := parseCron(s.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	loc, err := s.location()
+	if err != nil {
+		return time.Time{}
+	}
+	from := s.Created
+	if s.LastRun != nil {
+		from = s.LastRun.Scheduled
+	}
+	return spec.next(from.In(loc))
+}
+
+// The latest run due by now, if any.
+func (s *schedule) due(now time.Time) (time.Time, bool) {
+	next := s.next()
+	if next.IsZero() || next.After(now) {
+		return time.Time{}, false
+	}
+	spec, _ := parseCron(s.Cron)
+	for {
+		after := spec.next(next)
+		if after.IsZero() || after.After(now) {
+			return next, true
+		}
+		next = after
+	}
+}
+
+func (s *schedule) withNextRun() *schedule {
+	if next := s.next(); !next.IsZero() {
+		s.NextRun = &next
+	}
+	return s
+}
+
+func saveSchedule(ctx context.Context, s *schedule) error {
+	s.NextRun = nil
+	buff, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(getSchedulesPath(ctx), s.Id+".json"), buff, 0644)
+}
+
+func getSchedule(ctx context.Context, id string) (*schedule, error) {
+	buff, err := ioutil.ReadFile(path.Join(getSchedulesPath(ctx), path.Base(id)+".json"))
+	switch {
+	case os.IsNotExist(err):
+		return nil, newStatusError(http.StatusNotFound, ErrScheduleNotFound.Error()+":"+id)
+	case err != nil:
+		return nil, err
+	}
+	s := &schedule{}
+	if err := json.Unmarshal(buff, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func listSchedules(ctx context.Context) ([]*schedule, error) {
+	list := []*schedule{}
+	files, err := ioutil.ReadDir(getSchedulesPath(ctx))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		s, err := getSchedule(ctx, strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// Runs the schedules that are due, in the order they were due so that of a stop and a start
+// both missed the later one wins.
+func runSchedules(ctx context.Context, started time.Time) {
+	schedulesLock.Lock()
+	list, err := listSchedules(ctx)
+	schedulesLock.Unlock()
+	if err != nil {
+		glog.Warningln("Cannot list schedules", "Err=", err)
+		return
+	}
+
+	now := time.Now()
+	runs := []dueRun{}
+	for _, s := range list {
+		if scheduled, due := s.due(now); due {
+			runs = append(runs, dueRun{schedule: s, scheduled: scheduled})
+		}
+	}
+	sort.Sort(dueRunsByTime(runs))
+	for _, r := range runs {
+		runSchedule(ctx, r.schedule, r.scheduled, r.scheduled.Before(started))
+	}
+}
+
+func runSchedule(ctx context.Context, s *schedule, scheduled time.Time, caughtUp bool) {
+	targets := []machineRef{}
+	if s.Machine != "" {
+		targets = append(targets, machineRef{Driver: s.Driver, Name: s.Machine})
+	} else if selector, err := parseSelector(s.Selector); err == nil {
+		targets = selectMachines(ctx, s.Driver, selector)
+	}
+	glog.Infoln("Running schedule", s.Id, s.Action, "scheduled at", scheduled, "on", len(targets), "machines")
+
+	b := newBulkOperation(ctx, s.Action, s.Selector, targets,
+		bulkOptions{mode: BulkModeContinue, parallelism: DefaultBulkParallelism})
+	b.run(func(ctx context.Context, target machineRef) (map[string]interface{}, error) {
+		// Machines already where the action would take them are left alone.
+		lifecycle, err := getLifecycle(ctx, target.Driver, target.Name)
+		if err == nil && s.Action != "restart" && lifecycle == operationLifecycles[s.Action][1] {
+			return map[string]interface{}{
+				"name":      target.Name,
+				"lifecycle": lifecycle,
+			}, nil
+		}
+		return changeState(ctx, target.Driver, target.Name, s.Action, waitOptions{}, false)
+	})
+
+	report := b.snapshot()
+	run := &scheduleRun{
+		Scheduled: scheduled,
+		Started:   report.Started,
+		CaughtUp:  caughtUp,
+		Bulk:      report.Id,
+		Status:    report.Status,
+		Results:   report.Results,
+	}
+
+	schedulesLock.Lock()
+	defer schedulesLock.Unlock()
+	// The schedule may have been removed while it ran.
+	current, err := getSchedule(ctx, s.Id)
+	if err != nil {
+		return
+	}
+	current.LastRun = run
+	if err := saveSchedule(ctx, current); err != nil {
+		glog.Warningln("Cannot save schedule", s.Id, "Err=", err)
+	}
+}
+
+// Starts running the schedules.  Runs missed since the server last ran are caught up right
+// away.  Returns the function that stops the scheduler.
+func StartScheduler(interval time.Duration) func() {
+	if interval <= 0 {
+		interval = DefaultScheduleInterval
+	}
+	started := time.Now()
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			runSchedules(context.Background(), started)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
+
+func CreateSchedule(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	s := &schedule{}
+	if err := server.Unmarshal(resp, req, s); err != nil {
+		return
+	}
+	if err := s.validate(); err != nil {
+		renderError(ctx, err)
+		return
+	}
+	s.Id = mcnutils.TruncateID(mcnutils.GenerateRandomID())
+	s.Created = time.Now()
+	s.LastRun = nil
+
+	schedulesLock.Lock()
+	err := saveSchedule(ctx, s)
+	schedulesLock.Unlock()
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	server.Marshal(resp, req, s.withNextRun())
+}
+
+func ListSchedules(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	schedulesLock.Lock()
+	list, err := listSchedules(ctx)
+	schedulesLock.Unlock()
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, s := range list {
+		s.withNextRun()
+	}
+	server.Marshal(resp, req, list)
+}
+
+func GetSchedule(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	schedulesLock.Lock()
+	s, err := getSchedule(ctx, server.GetUrlParameter(req, "id"))
+	schedulesLock.Unlock()
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	server.Marshal(resp, req, s.withNextRun())
+}
+
+func RemoveSchedule(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	id := server.GetUrlParameter(req, "id")
+
+	schedulesLock.Lock()
+	defer schedulesLock.Unlock()
+	s, err := getSchedule(ctx, id)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if err := os.Remove(path.Join(getSchedulesPath(ctx), s.Id+".json")); err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	server.Marshal(resp, req, s)
+}
+
+type dueRun struct {
+	schedule  *schedule
+	scheduled time.Time
+}
+
+type dueRunsByTime []dueRun
+
+func (l dueRunsByTime) Len() int           { return len(l) }
+func (l dueRunsByTime) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l dueRunsByTime) Less(i, j int) bool { return l[i].scheduled.Before(l[j].scheduled) }
@@ -0,0 +1,264 @@
+package machine
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"github.com/conductant/gohm/pkg/server"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Auth scope needed to write, list and remove secrets.
+	SecretAdminScope = "secret-admin"
+
+	// Prefix of the scope needed to use a secret that does not name its own.
+	secretScopePrefix = "secret:"
+)
+
+var (
+	ErrSecretNotFound = errors.New("err-secret-not-found")
+	ErrNoSecretKey    = errors.New("err-no-secret-key")
+	ErrBadSecret      = errors.New("err-bad-secret")
+
+	secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+	secretKey     []byte
+	secretKeyLock sync.Mutex
+)
+
+// A secret as stored: the value is sealed with AES-GCM under the server's key, with the
+// name as additional data so that sealed values cannot be swapped between secrets.
+type secret struct {
+	Name    string    `json:"name"`
+	Scope   string    `json:"scope"`
+	Created time.Time `json:"created"`
+	Nonce   []byte    `json:"nonce,omitempty"`
+	Sealed  []byte    `json:"sealed,omitempty"`
+}
+
+// Sets the key secrets are encrypted with.  The AES-256 key is the sha256 of the key
+// material, so any file of enough random bytes will do.
+func SetSecretKey(material []byte) {
+	secretKeyLock.Lock()
+	defer secretKeyLock.Unlock()
+	if len(material) == 0 {
+		secretKey = nil
+		return
+	}
+	sum := sha256.Sum256(material)
+	secretKey = sum[:]
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	secretKeyLock.Lock()
+	key := secretKey
+	secretKeyLock.Unlock()
+	if key == nil {
+		return nil, newStatusError(http.StatusServiceUnavailable, ErrNoSecretKey.Error())
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func getSecretsPath(ctx context.Context) string {
+	p := path.Join(getStoreRoot(ctx), "secrets")
+	err := os.MkdirAll(p, 0700)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func getSecret(ctx context.Context, name string) (*secret, error) {
+	buff, err := ioutil.ReadFile(path.Join(getSecretsPath(ctx), path.Base(name)+".json"))
+	switch {
+	case os.IsNotExist(err):
+		return nil, newStatusError(http.StatusNotFound, ErrSecretNotFound.Error()+":"+name)
+	case err != nil:
+		return nil, err
+	}
+	s := &secret{}
+	if err := json.Unmarshal(buff, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Opens the secret, if the request has its scope.  Server side configuration such as the
+// accounts is trusted and need not have it.
+func openSecret(ctx context.Context, name string, trusted bool) (string, error) {
+	s, err := getSecret(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if !trusted && !hasScope(ctx, s.Scope) {
+		return "", newStatusError(http.StatusForbidden, ErrForbidden.Error()+":"+s.Scope)
+	}
+	aead, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	value, err := aead.Open(nil, s.Nonce, s.Sealed, []byte(s.Name))
+	if err != nil {
+		return "", errors.New(ErrBadSecret.Error() + ":" + name)
+	}
+	return string(value), nil
+}
+
+// The name of the secret if the value is a reference to one, as in {"secret": "do-team-a"}
+func secretRef(v interface{}) (string, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return "", false
+	}
+	name, ok := m["secret"].(string)
+	return name, ok
+}
+
+// Replaces the references to secrets in the flags with their values.  Returns the values with
+// their references so that they can be kept out of responses and the store.
+func resolveSecrets(ctx context.Context, flags map[string]interface{}, trusted bool) (credentialRefs, error) {
+	refs := credentialRefs{}
+	for k, v := range flags {
+		name, ok := secretRef(v)
+		if !ok {
+			continue
+		}
+		value, err := openSecret(ctx, name, trusted)
+		if err != nil {
+			return nil, err
+		}
+		flags[k] = value
+		if value != "" {
+			refs[value] = v
+		}
+	}
+	return refs, nil
+}
+
+// Redacts the values of resolved secrets wherever they appear in the configuration.
+func redactValues(config map[string]interface{}, values []string) {
+	for k, v := range config {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			redactValues(v, values)
+		case string:
+			for _, value := range values {
+				if value != "" && v == value {
+					config[k] = redacted
+				}
+			}
+		}
+	}
+}
+
+// Writes the secret.  The value is never returned by the api.
+func PutSecret(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	name := server.GetUrlParameter(req, "name")
+	if !secretNamePattern.MatchString(name) {
+		server.HandleError(ctx, http.StatusBadRequest, ErrBadSecret.Error()+":"+name)
+		return
+	}
+	input := struct {
+		Value string `json:"value"`
+		Scope string `json:"scope"`
+	}{}
+	if err := server.Unmarshal(resp, req, &input); err != nil {
+		return
+	}
+	if input.Value == "" {
+		server.HandleError(ctx, http.StatusBadRequest, ErrBadSecret.Error()+":"+name)
+		return
+	}
+	s, err := sealSecret(name, input.Scope, input.Value)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if err := saveSecret(ctx, s); err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	server.Marshal(resp, req, s.summary())
+}
+
+// Seals the value under the server's key.  The scope defaults to secret:<name>.
+func sealSecret(name, scope, value string) (*secret, error) {
+	aead, err := secretCipher()
+	if err != nil {
+		return nil, err
+	}
+	s := &secret{Name: name, Scope: scope, Created: time.Now()}
+	if s.Scope == "" {
+		s.Scope = secretScopePrefix + name
+	}
+	s.Nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, s.Nonce); err != nil {
+		return nil, err
+	}
+	s.Sealed = aead.Seal(nil, s.Nonce, []byte(value), []byte(s.Name))
+	return s, nil
+}
+
+func saveSecret(ctx context.Context, s *secret) error {
+	buff, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(getSecretsPath(ctx), s.Name+".json"), buff, 0600)
+}
+
+func (s *secret) summary() *secret {
+	return &secret{Name: s.Name, Scope: s.Scope, Created: s.Created}
+}
+
+func ListSecrets(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	list := []*secret{}
+	visitDir(getSecretsPath(ctx), func(f string) {
+		if !strings.HasSuffix(f, ".json") {
+			return
+		}
+		if s, err := getSecret(ctx, strings.TrimSuffix(f, ".json")); err == nil {
+			list = append(list, s.summary())
+		}
+	})
+	sort.Sort(secretsByName(list))
+	server.Marshal(resp, req, list)
+}
+
+func RemoveSecret(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	name := server.GetUrlParameter(req, "name")
+	s, err := getSecret(ctx, name)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if err := os.Remove(path.Join(getSecretsPath(ctx), path.Base(name)+".json")); err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	server.Marshal(resp, req, s.summary())
+}
+
+type secretsByName []*secret
+
+func (l secretsByName) Len() int           { return len(l) }
+func (l secretsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l secretsByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
@@ -0,0 +1,154 @@
+package machine
+
+import (
+	"golang.org/x/net/context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestSecretRoundTrip(t *testing.T) {
+	defer inTempStore(t)()
+	defer SetSecretKey(nil)
+
+	if _, err := sealSecret("none", "", "value"); statusOf(err) != http.StatusServiceUnavailable {
+		t.Errorf("no key: got %v", err)
+	}
+
+	SetSecretKey([]byte("key material"))
+	a, err := sealSecret("a", "", "token-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Scope != "secret:a" {
+		t.Errorf("default scope: got %s", a.Scope)
+	}
+	if string(a.Sealed) == "token-a" {
+		t.Errorf("not sealed")
+	}
+	b, err := sealSecret("b", "team-b", "token-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSecret(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSecret(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+
+	scoped := context.WithValue(context.Background(), "team-b", true)
+	for _, c := range []struct {
+		name    string
+		ctx     context.Context
+		secret  string
+		trusted bool
+		value   string
+		status  int
+	}{
+		{"trusted", context.Background(), "a", true, "token-a", 0},
+		{"with the scope", scoped, "b", false, "token-b", 0},
+		{"without the scope", scoped, "a", false, "", http.StatusForbidden},
+		{"not there", context.Background(), "c", true, "", http.StatusNotFound},
+	} {
+		value, err := openSecret(c.ctx, c.secret, c.trusted)
+		switch {
+		case c.status != 0 && (err == nil || statusOf(err) != c.status):
+			t.Errorf("%s: got %v", c.name, err)
+		case c.status == 0 && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case value != c.value:
+			t.Errorf("%s: got %q", c.name, value)
+		}
+	}
+
+	// The name is authenticated with the value, so a sealed value cannot be moved to another
+	// secret.
+	swapped := *b
+	swapped.Nonce, swapped.Sealed = a.Nonce, a.Sealed
+	if err := saveSecret(context.Background(), &swapped); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openSecret(context.Background(), "b", true); err == nil {
+		t.Errorf("swapped: opened")
+	}
+
+	SetSecretKey([]byte("another key"))
+	if _, err := openSecret(context.Background(), "a", true); err == nil {
+		t.Errorf("another key: opened")
+	}
+}
+
+func TestCredentialRefs(t *testing.T) {
+	defer inTempStore(t)()
+	defer SetSecretKey(nil)
+
+	SetSecretKey([]byte("key material"))
+	s, err := sealSecret("do", "", "do-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSecret(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+
+	ref := map[string]interface{}{"secret": "do"}
+	refs := credentialRefs{"do-token": ref}
+	config := map[string]interface{}{
+		"AccessToken": "do-token",
+		"Region":      "nyc3",
+		"Nested":      map[string]interface{}{"Token": "do-token"},
+	}
+	refs.seal(config)
+	sealed := map[string]interface{}{
+		"AccessToken": ref,
+		"Region":      "nyc3",
+		"Nested":      map[string]interface{}{"Token": ref},
+	}
+	if !reflect.DeepEqual(config, sealed) {
+		t.Fatalf("sealed: got %v", config)
+	}
+
+	// The machine's own secrets are opened as trusted; those of the original of a clone need
+	// the scope.
+	if _, err := resolveRefs(context.Background(), "digitalocean", copyConfig(config), false); statusOf(err) != http.StatusForbidden {
+		t.Errorf("untrusted without the scope: got %v", err)
+	}
+	scoped := context.WithValue(context.Background(), "secret:do", true)
+	for _, c := range []struct {
+		ctx     context.Context
+		trusted bool
+	}{
+		{scoped, false},
+		{context.Background(), true},
+	} {
+		resolved := copyConfig(config)
+		got, err := resolveRefs(c.ctx, "digitalocean", resolved, c.trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, refs) {
+			t.Errorf("refs: got %v", got)
+		}
+		if resolved["AccessToken"] != "do-token" || resolved["Nested"].(map[string]interface{})["Token"] != "do-token" {
+			t.Errorf("resolved: got %v", resolved)
+		}
+		redactValues(resolved, got.values())
+		if resolved["AccessToken"] != redacted || resolved["Region"] != "nyc3" {
+			t.Errorf("redacted: got %v", resolved)
+		}
+	}
+}
+
+func copyConfig(config map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{}
+	for k, v := range config {
+		if nested, ok := v.(map[string]interface{}); ok {
+			if _, isRef := secretRef(nested); !isRef {
+				v = copyConfig(nested)
+			}
+		}
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,407 @@
+package machine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/conductant/kat-machine/pkg/websocket"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Auth scope needed to open a shell on machines.
+	ShellScope = "machine-shell"
+
+	DefaultShellIdleTimeout = 15 * time.Minute
+	DefaultShellTerm        = "xterm"
+	DefaultShellCols        = 80
+	DefaultShellRows        = 24
+)
+
+var (
+	ErrSessionNotFound = errors.New("err-session-not-found")
+
+	// Origins of pages other than the server's own that may open shells.
+	shellOrigins []string
+)
+
+func SetShellOrigins(origins []string) {
+	shellOrigins = origins
+}
+
+// A message from the terminal other than its input, which comes in binary messages.
+type shellControl struct {
+	Type string `json:"type"` // resize or input
+	Cols int    `json:"cols,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+	Data string `json:"data,omitempty"`
+}
+
+// Records the output of a shell in the asciicast v2 format, which players can replay.
+type shellRecorder struct {
+	lock    sync.Mutex
+	file    *os.File
+	started time.Time
+}
+
+func getMachineSessionsPath(ctx context.Context, provider, hostName string) string {
+	p := path.Join(getMachinePath(ctx, provider, hostName), "sessions")
+	err := os.MkdirAll(p, 0700)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func newShellRecorder(ctx context.Context, provider, hostName, id string, cols, rows int, term string) (*shellRecorder, error) {
+	f, err := os.OpenFile(path.Join(getMachineSessionsPath(ctx, provider, hostName), id+".cast"),
+		os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &shellRecorder{file: f, started: time.Now()}
+	header, _ := json.Marshal(map[string]interface{}{
+		"version":   2,
+		"width":     cols,
+		"height":    rows,
+		"timestamp": r.started.Unix(),
+		"env":       map[string]string{"TERM": term},
+		"title":     hostName,
+	})
+	if _, err := f.Write(append(header, '\n')); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *shellRecorder) record(kind, data string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	line, _ := json.Marshal([]interface{}{time.Since(r.started).Seconds(), kind, data})
+	r.file.Write(append(line, '\n'))
+}
+
+func (r *shellRecorder) close() {
+	if r != nil {
+		r.file.Close()
+	}
+}
+
+func getShellSize(req *http.Request) (int, int, error) {
+	size := []int{DefaultShellCols, DefaultShellRows}
+	for i, key := range []string{"cols", "rows"} {
+		if v := server.GetUrlParameter(req, key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 1000 {
+				return 0, 0, newStatusError(http.StatusBadRequest, "err-bad-"+key+":"+v)
+			}
+			size[i] = n
+		}
+	}
+	return size[0], size[1], nil
+}
+
+// Opens an interactive shell on the machine over a websocket.  Binary messages carry the
+// terminal both ways; text messages from the terminal are resizes or input as json.  The
+// session ends when the shell exits, the terminal goes away or nothing happens for the idle
+// timeout.  With ?record=true the output is kept in the store for replay.
+//
+// libmachine's NativeClient.Shell and OutputWithPty are tied to the terminal of the process
+// itself, so the pty is requested on a session of the same kind of connection instead.
+func OpenShell(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+
+	cols, rows, err := getShellSize(req)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	term := server.GetUrlParameter(req, "term")
+	if term == "" {
+		term = DefaultShellTerm
+	}
+	idle := DefaultShellIdleTimeout
+	if v := server.GetUrlParameter(req, "idle"); v != "" {
+		if idle, err = time.ParseDuration(v); err != nil || idle <= 0 {
+			server.HandleError(ctx, http.StatusBadRequest, "err-bad-idle:"+v)
+			return
+		}
+	}
+	record := server.GetUrlParameter(req, "record") == "true"
+
+	driver, err := restoreDriver(ctx, driverName, hostName)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+
+	// Nothing is opened on the machine or in the store for a request that is not let through.
+	conn, err := websocket.Upgrade(resp, req, shellOrigins)
+	if err != nil {
+		glog.Warningln("Cannot open shell on", hostName, "Err=", err)
+		return
+	}
+	defer conn.Close()
+	// From here on errors can only go to the terminal, as the reason of the close.
+	fail := func(err error) {
+		glog.Warningln("Cannot open shell on", hostName, "Err=", err)
+		conn.WriteClose(websocket.CloseInternalError, err.Error())
+	}
+
+	client, err := dialSSH(driver)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer session.Close()
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(term, rows, cols, modes); err != nil {
+		fail(err)
+		return
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		fail(err)
+		return
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		fail(err)
+		return
+	}
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	id := mcnutils.TruncateID(mcnutils.GenerateRandomID())
+	var recorder *shellRecorder
+	if record {
+		if recorder, err = newShellRecorder(ctx, driverName, hostName, id, cols, rows, term); err != nil {
+			fail(err)
+			return
+		}
+		defer recorder.close()
+	}
+
+	if err := session.Shell(); err != nil {
+		fail(err)
+		return
+	}
+
+	started := time.Now()
+	writeAudit(ctx, driverName, hostName, auditEntry{Action: "shell", Detail: "open " + id})
+
+	// Activity in either direction pushes the idle deadline back.
+	active := make(chan struct{}, 1)
+	touch := func() {
+		select {
+		case active <- struct{}{}:
+		default:
+		}
+	}
+	ended := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(idle)
+		defer timer.Stop()
+		for {
+			select {
+			case <-active:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(idle)
+			case <-timer.C:
+				glog.Infoln("Closing idle shell", id, "on", hostName)
+				conn.WriteClose(websocket.CloseGoingAway, "idle")
+				client.Close()
+				return
+			case <-ended:
+				return
+			}
+		}
+	}()
+
+	output := func(r io.Reader) {
+		buff := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buff)
+			if n > 0 {
+				touch()
+				recorder.record("o", string(buff[:n]))
+				if conn.WriteMessage(websocket.BinaryMessage, buff[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	copied := sync.WaitGroup{}
+	copied.Add(2)
+	go func() { output(stdout); copied.Done() }()
+	go func() { output(stderr); copied.Done() }()
+
+	// The terminal goes away: the shell is hung up on.
+	go func() {
+		defer session.Close()
+		for {
+			op, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			touch()
+			if op == websocket.BinaryMessage {
+				stdin.Write(data)
+				continue
+			}
+			control := shellControl{}
+			if err := json.Unmarshal(data, &control); err != nil {
+				continue
+			}
+			switch control.Type {
+			case "input":
+				stdin.Write([]byte(control.Data))
+			case "resize":
+				if control.Cols > 0 && control.Rows > 0 {
+					session.SendRequest("window-change", false, ssh.Marshal(&windowChange{
+						Columns: uint32(control.Cols),
+						Rows:    uint32(control.Rows),
+					}))
+					recorder.record("r", fmt.Sprintf("%dx%d", control.Cols, control.Rows))
+				}
+			}
+		}
+	}()
+
+	copied.Wait()
+	err = session.Wait()
+	close(ended)
+	code := exitStatus(err)
+
+	exit, _ := json.Marshal(map[string]interface{}{"type": "exit", "exit_code": code})
+	conn.WriteMessage(websocket.TextMessage, exit)
+	conn.WriteClose(websocket.CloseNormal, "")
+
+	writeAudit(ctx, driverName, hostName, auditEntry{
+		Action:   "shell",
+		Detail:   "close " + id,
+		ExitCode: &code,
+		Duration: time.Since(started).String(),
+	})
+}
+
+// The payload of the window-change request, RFC 4254 section 6.7.
+type windowChange struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+// A recorded shell session.
+type sessionSummary struct {
+	Id      string    `json:"id"`
+	Started time.Time `json:"started"`
+	Size    int64     `json:"size"`
+}
+
+func ListSessions(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+	list := []sessionSummary{}
+	files, err := ioutil.ReadDir(path.Join(machineDir(ctx, driverName, hostName), "sessions"))
+	if err != nil && !os.IsNotExist(err) {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".cast") {
+			continue
+		}
+		summary := sessionSummary{Id: strings.TrimSuffix(f.Name(), ".cast"), Size: f.Size()}
+		if started, err := readSessionStart(path.Join(machineDir(ctx, driverName, hostName), "sessions", f.Name())); err == nil {
+			summary.Started = started
+		}
+		list = append(list, summary)
+	}
+	sort.Sort(sessionsByStart(list))
+	server.Marshal(resp, req, list)
+}
+
+// The start of a recording, from the timestamp in its header line.
+func readSessionStart(p string) (time.Time, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return time.Time{}, err
+	}
+	header := struct {
+		Timestamp int64 `json:"timestamp"`
+	}{}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(header.Timestamp, 0), nil
+}
+
+// Gets the recording of a session as asciicast.
+func GetSession(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	driverName := server.GetUrlParameter(req, "driver")
+	hostName := server.GetUrlParameter(req, "name")
+	id := path.Base(server.GetUrlParameter(req, "id"))
+	buff, err := ioutil.ReadFile(path.Join(machineDir(ctx, driverName, hostName), "sessions", id+".cast"))
+	switch {
+	case os.IsNotExist(err):
+		server.HandleError(ctx, http.StatusNotFound, ErrSessionNotFound.Error()+":"+id)
+		return
+	case err != nil:
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp.Header().Set("Content-Type", "application/x-asciicast")
+	resp.Write(buff)
+}
+
+type sessionsByStart []sessionSummary
+
+func (l sessionsByStart) Len() int           { return len(l) }
+func (l sessionsByStart) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l sessionsByStart) Less(i, j int) bool { return l[i].Started.Before(l[j].Started) }
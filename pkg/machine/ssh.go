@@ -0,0 +1,117 @@
+package machine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/docker/machine/libmachine/drivers"
+	mcnssh "github.com/docker/machine/libmachine/ssh"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	sshDialTimeout = 30 * time.Second
+)
+
+var (
+	ErrNoSSH        = errors.New("err-no-ssh")
+	ErrSSHTimeout   = errors.New("err-ssh-timeout")
+	ErrNoExitStatus = errors.New("err-no-exit-status")
+)
+
+// Dials the machine with the address, user and key of its driver, configured as libmachine's
+// native client is.  Unlike the libmachine client, the connection gives sessions with stdin,
+// exit status and ptys.
+func dialSSH(driver drivers.Driver) (*ssh.Client, error) {
+	return dialSSHWithKey(driver, driver.GetSSHKeyPath())
+}
+
+// Dials the machine as dialSSH does, but with the given private key.
+func dialSSHWithKey(driver drivers.Driver, key string) (*ssh.Client, error) {
+	host, err := driver.GetSSHHostname()
+	if err != nil {
+		return nil, newStatusError(http.StatusBadGateway, ErrNoSSH.Error()+":"+err.Error())
+	}
+	port, err := driver.GetSSHPort()
+	if err != nil {
+		return nil, newStatusError(http.StatusBadGateway, ErrNoSSH.Error()+":"+err.Error())
+	}
+	auth := &mcnssh.Auth{}
+	if key != "" {
+		auth.Keys = []string{key}
+	}
+	config, err := mcnssh.NewNativeConfig(driver.GetSSHUsername(), auth)
+	if err != nil {
+		return nil, err
+	}
+
+	address := net.JoinHostPort(host, fmt.Sprint(port))
+	conn, err := net.DialTimeout("tcp", address, sshDialTimeout)
+	if err != nil {
+		return nil, newStatusError(http.StatusBadGateway, ErrNoSSH.Error()+":"+err.Error())
+	}
+	conn.SetDeadline(time.Now().Add(sshDialTimeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, &config)
+	if err != nil {
+		conn.Close()
+		return nil, newStatusError(http.StatusBadGateway, ErrNoSSH.Error()+":"+err.Error())
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// The exit status of a finished session, or -1 if the command did not exit normally.
+func exitStatus(err error) int {
+	switch err := err.(type) {
+	case nil:
+		return 0
+	case *ssh.ExitError:
+		return err.ExitStatus()
+	}
+	return -1
+}
+
+// Runs the command over ssh with the stdin, and returns its output, stdout and stderr as they
+// come, and exit status.  The command is killed when it runs out of time.
+func runSSHCommand(driver drivers.Driver, command string, stdin []byte, timeout time.Duration) ([]byte, int, error) {
+	client, err := dialSSH(driver)
+	if err != nil {
+		return nil, -1, err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, -1, newStatusError(http.StatusBadGateway, err.Error())
+	}
+	defer session.Close()
+	session.Stdin = bytes.NewReader(stdin)
+
+	done := make(chan struct{})
+	timedOut := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			close(timedOut)
+			session.Signal(ssh.SIGKILL)
+			client.Close()
+		case <-done:
+		}
+	}()
+	output, err := session.CombinedOutput(command)
+	close(done)
+
+	select {
+	case <-timedOut:
+		return output, -1, newStatusError(http.StatusGatewayTimeout, ErrSSHTimeout.Error()+":"+timeout.String())
+	default:
+	}
+	if _, exited := err.(*ssh.ExitError); err != nil && !exited {
+		return output, -1, newStatusError(http.StatusBadGateway, ErrNoExitStatus.Error()+":"+err.Error())
+	}
+	return output, exitStatus(err), nil
+}
@@ -0,0 +1,419 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/conductant/gohm/pkg/encoding"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/conductant/kat-machine/pkg/provision"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Auth scope needed to save or remove a template.
+	TemplateScope = "machine-template"
+)
+
+var (
+	ErrTemplateNotFound   = errors.New("err-template-not-found")
+	ErrOverrideNotAllowed = errors.New("err-override-not-allowed")
+
+	templatesLock sync.Mutex
+)
+
+// A named set of defaults for creating machines.  Every change of a template is saved as a
+// new version, so machines can be traced back to the exact defaults they were created with.
+type template struct {
+	Name    string    `json:"name"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+
+	Driver string            `json:"driver"`
+	Flags  jsonFlags         `json:"flags,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Provisioning steps, run ahead of those in the create payload.
+	Provision []provisionStep `json:"provision,omitempty"`
+
+	// The Docker engine to install, unless the create payload has its own.
+	Engine *provision.EngineOptions `json:"engine,omitempty"`
+
+	// The swarm cluster machines join, unless the create payload names another.
+	Cluster string `json:"cluster,omitempty"`
+
+	// Health probes, checked along with those in the create payload.
+	Health []healthProbe `json:"health,omitempty"`
+
+	// The driver flags a create payload may set in addition to, or over, the template's.
+	// kat-machine's own fields such as labels and ttl can always be set.
+	Overrides []string `json:"overrides,omitempty"`
+}
+
+// The template version a machine was created from.
+type templateRef struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+}
+
+func getTemplatesPath(ctx context.Context) string {
+	p := path.Join(getStoreRoot(ctx), "templates")
+	err := os.MkdirAll(p, 0755)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Versions of the template, oldest first.  Each is stored as <version>.json in the directory
+// of the template.
+func listTemplateVersions(ctx context.Context, name string) ([]int, error) {
+	versions := []int{}
+	files, err := ioutil.ReadDir(path.Join(getTemplatesPath(ctx), path.Base(name)))
+	switch {
+	case os.IsNotExist(err):
+		return versions, nil
+	case err != nil:
+		return nil, err
+	}
+	for _, f := range files {
+		if v, err := strconv.Atoi(strings.TrimSuffix(f.Name(), ".json")); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// Reads a version of the template, or the latest when version is 0.
+func getTemplate(ctx context.Context, name string, version int) (*template, error) {
+	notFound := newStatusError(http.StatusNotFound, ErrTemplateNotFound.Error()+":"+name)
+	if version == 0 {
+		versions, err := listTemplateVersions(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			return nil, notFound
+		}
+		version = versions[len(versions)-1]
+	}
+	buff, err := ioutil.ReadFile(path.Join(getTemplatesPath(ctx), path.Base(name), fmt.Sprintf("%d.json", version)))
+	switch {
+	case os.IsNotExist(err):
+		return nil, notFound
+	case err != nil:
+		return nil, err
+	}
+	t := &template{}
+	if err := json.Unmarshal(buff, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *template) validate(ctx context.Context) error {
+	driver, _, err := getDriver(ctx, t.Driver, "")
+	if err != nil {
+		return newStatusError(http.StatusNotFound, "err-not-found:"+t.Driver)
+	}
+	if err := validateInput(driver, t.Flags); err != nil {
+		return newStatusError(http.StatusBadRequest, err.Error())
+	}
+	overrides := jsonFlags{}
+	for _, key := range t.Overrides {
+		overrides[key] = nil
+	}
+	if err := validateInput(driver, overrides); err != nil {
+		return newStatusError(http.StatusBadRequest, err.Error())
+	}
+	if _, err := expandSteps(t.Provision); err != nil {
+		return err
+	}
+	if _, err := normalizeProbes(t.Health); err != nil {
+		return err
+	}
+	if t.Engine != nil {
+		if err := t.Engine.Normalize(); err != nil {
+			return newStatusError(http.StatusBadRequest, err.Error())
+		}
+	}
+	return nil
+}
+
+// Merges the create payload over the template.  Driver flags in the payload must be allowed
+// overrides; labels are merged with the template's and provisioning steps follow the template's.
+func (t *template) merge(payload jsonFlags) (jsonFlags, error) {
+	allowed := map[string]bool{}
+	for _, key := range t.Overrides {
+		allowed[key] = true
+	}
+	for _, key := range createOptionKeys {
+		allowed[key] = true
+	}
+	denied := []string{}
+	for key, _ := range payload {
+		if !allowed[key] {
+			denied = append(denied, key)
+		}
+	}
+	if len(denied) > 0 {
+		sort.Strings(denied)
+		return nil, newStatusError(http.StatusBadRequest, ErrOverrideNotAllowed.Error()+":"+strings.Join(denied, ","))
+	}
+
+	merged := jsonFlags{}
+	for k, v := range t.Flags {
+		merged[k] = v
+	}
+	for k, v := range payload {
+		merged[k] = v
+	}
+	if len(t.Labels) > 0 {
+		labels := map[string]interface{}{}
+		for k, v := range t.Labels {
+			labels[k] = v
+		}
+		if own, ok := payload["labels"].(map[string]interface{}); ok {
+			for k, v := range own {
+				labels[k] = v
+			}
+		}
+		merged["labels"] = labels
+	}
+	if len(t.Provision) > 0 {
+		steps := []interface{}{}
+		buff, err := json.Marshal(t.Provision)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(buff, &steps); err != nil {
+			return nil, err
+		}
+		if own, ok := payload["provision"].([]interface{}); ok {
+			steps = append(steps, own...)
+		}
+		merged["provision"] = steps
+	}
+	if len(t.Health) > 0 {
+		probes := []interface{}{}
+		buff, err := json.Marshal(t.Health)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(buff, &probes); err != nil {
+			return nil, err
+		}
+		if own, ok := payload["health"].([]interface{}); ok {
+			probes = append(probes, own...)
+		}
+		merged["health"] = probes
+	}
+	if _, has := payload["engine"]; !has && t.Engine != nil {
+		merged["engine"] = t.Engine
+	}
+	if _, has := payload["cluster"]; !has && t.Cluster != "" {
+		merged["cluster"] = t.Cluster
+	}
+	return merged, nil
+}
+
+// The template with secret flag values redacted, for responses.
+func (t *template) redacted() *template {
+	r := *t
+	r.Flags = jsonFlags{}
+	for k, v := range t.Flags {
+		r.Flags[k] = v
+	}
+	redact(r.Flags)
+	return &r
+}
+
+func getTemplateVersion(req *http.Request) (int, error) {
+	if v := server.GetUrlParameter(req, "version"); v != "" {
+		version, err := strconv.Atoi(v)
+		if err != nil || version < 1 {
+			return 0, newStatusError(http.StatusBadRequest, "err-bad-version:"+v)
+		}
+		return version, nil
+	}
+	return 0, nil
+}
+
+// Saves the posted template as its next version.
+func SaveTemplate(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	t := &template{}
+	if err := server.Unmarshal(resp, req, t); err != nil {
+		return
+	}
+	t.Name = server.GetUrlParameter(req, "template")
+	if err := t.validate(ctx); err != nil {
+		renderError(ctx, err)
+		return
+	}
+
+	templatesLock.Lock()
+	defer templatesLock.Unlock()
+
+	versions, err := listTemplateVersions(ctx, t.Name)
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	t.Version = 1
+	if len(versions) > 0 {
+		t.Version = versions[len(versions)-1] + 1
+	}
+	t.Created = time.Now()
+
+	buff, err := json.MarshalIndent(t, "", " ")
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	dir := path.Join(getTemplatesPath(ctx), path.Base(t.Name))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := ioutil.WriteFile(path.Join(dir, fmt.Sprintf("%d.json", t.Version)), buff, 0600); err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	server.Marshal(resp, req, t.redacted())
+}
+
+// Lists the latest version of each template.
+func ListTemplates(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	list := []*template{}
+	visitDir(getTemplatesPath(ctx), func(name string) {
+		if t, err := getTemplate(ctx, name, 0); err == nil {
+			list = append(list, t.redacted())
+		}
+	})
+	server.Marshal(resp, req, list)
+}
+
+// Gets the latest version of the template, or the one asked for with ?version=
+func GetTemplate(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	version, err := getTemplateVersion(req)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	t, err := getTemplate(ctx, server.GetUrlParameter(req, "template"), version)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	server.Marshal(resp, req, t.redacted())
+}
+
+func ListTemplateVersions(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	name := server.GetUrlParameter(req, "template")
+	versions, err := listTemplateVersions(ctx, name)
+	if err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	list := []*template{}
+	for _, v := range versions {
+		if t, err := getTemplate(ctx, name, v); err == nil {
+			list = append(list, t.redacted())
+		}
+	}
+	if len(list) == 0 {
+		server.HandleError(ctx, http.StatusNotFound, ErrTemplateNotFound.Error()+":"+name)
+		return
+	}
+	server.Marshal(resp, req, list)
+}
+
+// Removes the template with all its versions.  Machines created from it keep their reference.
+func RemoveTemplate(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	name := server.GetUrlParameter(req, "template")
+
+	templatesLock.Lock()
+	defer templatesLock.Unlock()
+
+	t, err := getTemplate(ctx, name, 0)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if err := os.RemoveAll(path.Join(getTemplatesPath(ctx), path.Base(name))); err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	server.Marshal(resp, req, t.redacted())
+}
+
+// Creates a machine from the template merged with the payload.  The payload may be empty.
+func CreateFromTemplate(ctx context.Context, resp http.ResponseWriter, req *http.Request) {
+	version, err := getTemplateVersion(req)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	t, err := getTemplate(ctx, server.GetUrlParameter(req, "template"), version)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+
+	r := createRequest{
+		Driver:         t.Driver,
+		Name:           server.GetUrlParameter(req, "name"),
+		IdempotencyKey: req.Header.Get(IdempotencyKeyHeader),
+		ContentType:    encoding.ContentTypeJSON.String(),
+		Template:       &templateRef{Name: t.Name, Version: t.Version},
+	}
+	if r.Wait, err = getWaitOptions(req); err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.DryRun, err = getDryRun(req); err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		server.HandleError(ctx, http.StatusBadRequest, err.Error())
+		return
+	}
+	payload := jsonFlags{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		contentType, err := encoding.ContentTypeFromString(server.ContentTypeForRequest(req))
+		if err != nil {
+			server.HandleError(ctx, http.StatusBadRequest, server.ErrBadContentType.Error())
+			return
+		}
+		if err := encoding.Unmarshal(contentType, bytes.NewReader(body), &payload); err != nil {
+			server.HandleError(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	merged, err := t.merge(payload)
+	if err != nil {
+		renderError(ctx, err)
+		return
+	}
+	if r.Payload, err = json.Marshal(merged); err != nil {
+		server.HandleError(ctx, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	result, err := createMachine(ctx, r)
+	renderCreate(ctx, resp, req, result, err)
+}
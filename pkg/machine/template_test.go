@@ -0,0 +1,86 @@
+package machine
+
+import (
+	"encoding/json"
+	"github.com/conductant/kat-machine/pkg/provision"
+	"reflect"
+	"testing"
+)
+
+func TestTemplateMerge(t *testing.T) {
+	tmpl := &template{
+		Name:   "ci",
+		Driver: "digitalocean",
+		Flags: jsonFlags{
+			"digitalocean-region": "nyc3",
+			"digitalocean-size":   "512mb",
+		},
+		Labels:    map[string]string{"team": "ci", "env": "dev"},
+		Provision: []provisionStep{{Name: "base", Script: "apt-get update"}},
+		Engine:    &provision.EngineOptions{Port: 2376},
+		Cluster:   "ci",
+		Health:    []healthProbe{{Type: "tcp", Port: 22}},
+		Overrides: []string{"digitalocean-size"},
+	}
+
+	for _, c := range []struct {
+		name    string
+		payload string
+		merged  string
+		denied  bool
+	}{
+		{"nothing over the template", `{}`, `{
+			"digitalocean-region": "nyc3", "digitalocean-size": "512mb",
+			"labels": {"team": "ci", "env": "dev"},
+			"provision": [{"name": "base", "script": "apt-get update"}],
+			"engine": {"port": 2376}, "cluster": "ci",
+			"health": [{"type": "tcp", "port": 22}]}`, false},
+		{"allowed override and own fields", `{
+			"digitalocean-size": "1gb", "ttl": "24h",
+			"labels": {"env": "staging", "owner": "ops"},
+			"provision": [{"script": "make"}],
+			"engine": {"port": 2377}, "cluster": "other",
+			"health": [{"type": "http", "port": 80}]}`, `{
+			"digitalocean-region": "nyc3", "digitalocean-size": "1gb", "ttl": "24h",
+			"labels": {"team": "ci", "env": "staging", "owner": "ops"},
+			"provision": [{"name": "base", "script": "apt-get update"}, {"script": "make"}],
+			"engine": {"port": 2377}, "cluster": "other",
+			"health": [{"type": "tcp", "port": 22}, {"type": "http", "port": 80}]}`, false},
+		{"flag that is not an override", `{"digitalocean-region": "sfo1"}`, ``, true},
+		{"unknown flag", `{"digitalocean-size": "1gb", "foo": 1}`, ``, true},
+	} {
+		payload := jsonFlags{}
+		if err := json.Unmarshal([]byte(c.payload), &payload); err != nil {
+			t.Fatal(err)
+		}
+		merged, err := tmpl.merge(payload)
+		if c.denied {
+			if err == nil || statusOf(err) != 400 {
+				t.Errorf("%s: got %v", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		// Compared as json, as the template's own fields are structs until marshalled.
+		buff, err := json.Marshal(merged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, want := map[string]interface{}{}, map[string]interface{}{}
+		json.Unmarshal(buff, &got)
+		if err := json.Unmarshal([]byte(c.merged), &want); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %s", c.name, buff)
+		}
+	}
+
+	// Nothing of the template is changed by a merge.
+	if tmpl.Labels["env"] != "dev" || len(tmpl.Provision) != 1 || len(tmpl.Health) != 1 {
+		t.Errorf("template changed: %+v", tmpl)
+	}
+}
@@ -0,0 +1,122 @@
+package machine
+
+import (
+	"errors"
+	"github.com/conductant/gohm/pkg/server"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultWaitTimeout = 5 * time.Minute
+
+	// Same interval as mcnutils.WaitFor
+	waitInterval = 3 * time.Second
+)
+
+var (
+	ErrUnknownState = errors.New("err-unknown-state")
+	ErrWaitTimeout  = errors.New("err-wait-timeout")
+)
+
+// What to wait for after an action, as given by the url queries wait, timeout and wait_for_ssh.
+type waitOptions struct {
+	State   *state.State
+	Timeout time.Duration
+	SSH     bool
+}
+
+func (o waitOptions) needed() bool {
+	return o.State != nil || o.SSH
+}
+
+func getWaitOptions(req *http.Request) (opts waitOptions, err error) {
+	opts.Timeout = DefaultWaitTimeout
+	if v := server.GetUrlParameter(req, "wait"); v != "" {
+		s, err := parseState(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.State = &s
+	}
+	if v := server.GetUrlParameter(req, "timeout"); v != "" {
+		if opts.Timeout, err = time.ParseDuration(v); err != nil {
+			return opts, err
+		}
+	}
+	if v := server.GetUrlParameter(req, "wait_for_ssh"); v != "" {
+		if opts.SSH, err = strconv.ParseBool(v); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+func parseState(s string) (state.State, error) {
+	for st := state.Running; st.String() != ""; st++ {
+		if strings.EqualFold(st.String(), s) {
+			return st, nil
+		}
+	}
+	return state.None, ErrUnknownState
+}
+
+// Waits with the libmachine helpers for the machine to be in the desired state and then, if
+// asked, for ssh.  Both share the timeout.  The helpers have no deadline of their own, so
+// they run in the background and the wait is registered as an operation, which gives up
+// on them at the timeout or when it is cancelled.
+func waitFor(ctx context.Context, provider string, driver drivers.Driver, hostName string, opts waitOptions) error {
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	o := &operation{
+		Id:        mcnutils.TruncateID(mcnutils.GenerateRandomID()),
+		Driver:    provider,
+		Name:      hostName,
+		Operation: "wait",
+		Started:   time.Now(),
+		Deadline:  time.Now().Add(opts.Timeout),
+		cancel:    cancel,
+	}
+	unregister := registerOperation(o)
+	defer unregister()
+
+	done := make(chan error, 1)
+	go func() {
+		if opts.State != nil {
+			// Only as many polls as fit in the timeout, so that it does not go on for long
+			// after the wait has given up.
+			attempts := int(opts.Timeout/waitInterval) + 1
+			if err := mcnutils.WaitForSpecific(drivers.MachineInState(driver, *opts.State), attempts, waitInterval); err != nil {
+				done <- err
+				return
+			}
+		}
+		if opts.SSH {
+			done <- drivers.WaitForSSH(driver)
+			return
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			glog.Warningln("Waiting for", hostName, "Err=", err)
+			return ErrWaitTimeout
+		}
+		return nil
+	case <-ctx.Done():
+	}
+	if ctx.Err() == context.Canceled {
+		return ErrOperationCancelled
+	}
+	return ErrWaitTimeout
+}
@@ -0,0 +1,231 @@
+package provision
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOrganization = "kat-machine"
+	DefaultKeyBits      = 2048
+
+	// Same validity as the certificates docker-machine generates.
+	CAValidity   = 3 * 365 * 24 * time.Hour
+	CertValidity = 3 * 365 * 24 * time.Hour
+
+	CACertFile = "ca.pem"
+	CAKeyFile  = "ca-key.pem"
+)
+
+var (
+	ErrBadPEM = errors.New("err-bad-pem")
+
+	caLock sync.Mutex
+)
+
+// The certificate authority that signs the certificates of the engines and their clients.
+type CA struct {
+	Cert    *x509.Certificate
+	Key     *rsa.PrivateKey
+	CertPEM []byte
+}
+
+// A certificate and its key, PEM encoded.
+type KeyPair struct {
+	Cert []byte `json:"cert"`
+	Key  []byte `json:"key"`
+}
+
+// Loads the CA kept in the directory, creating it the first time.
+func LoadOrCreateCA(dir string) (*CA, error) {
+	caLock.Lock()
+	defer caLock.Unlock()
+
+	certPath, keyPath := path.Join(dir, CACertFile), path.Join(dir, CAKeyFile)
+	certPEM, err := ioutil.ReadFile(certPath)
+	switch {
+	case err == nil:
+		keyPEM, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		return parseCA(certPEM, keyPEM)
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, DefaultKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	template, err := newTemplate(DefaultOrganization+" CA", CAValidity)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	pair := encode(der, key)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyPath, pair.Key, 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(certPath, pair.Cert, 0644); err != nil {
+		return nil, err
+	}
+	return parseCA(pair.Cert, pair.Key)
+}
+
+func parseCA(certPEM, keyPEM []byte) (*CA, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, ErrBadPEM
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, Key: key, CertPEM: certPEM}, nil
+}
+
+// Issues the certificate of an engine.  The hosts are IP addresses or DNS names, the first
+// of which is normally the IP of the machine.
+func (ca *CA) IssueServer(hosts []string) (*KeyPair, error) {
+	template, err := serverTemplate(hosts)
+	if err != nil {
+		return nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	return ca.issue(template)
+}
+
+// Issues a certificate for a server that is also a client of the engines, such as a swarm
+// manager.
+func (ca *CA) IssuePeer(hosts []string) (*KeyPair, error) {
+	template, err := serverTemplate(hosts)
+	if err != nil {
+		return nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	return ca.issue(template)
+}
+
+func serverTemplate(hosts []string) (*x509.Certificate, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("err-no-hosts")
+	}
+	template, err := newTemplate(hosts[0], CertValidity)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if h != "" {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	return template, nil
+}
+
+// Issues a client certificate valid for as long as given.  The common name is the identity
+// of the client, as seen by anything that checks it.
+func (ca *CA) IssueClient(commonName string, validity time.Duration) (*KeyPair, error) {
+	template, err := newTemplate(commonName, validity)
+	if err != nil {
+		return nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return ca.issue(template)
+}
+
+func (ca *CA) issue(template *x509.Certificate) (*KeyPair, error) {
+	key, err := rsa.GenerateKey(rand.Reader, DefaultKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, &key.PublicKey, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	return encode(der, key), nil
+}
+
+func newTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   commonName,
+			Organization: []string{DefaultOrganization},
+		},
+		// Allow for clocks that are a little behind.
+		NotBefore: now.Add(-5 * time.Minute),
+		NotAfter:  now.Add(validity),
+	}, nil
+}
+
+func encode(der []byte, key *rsa.PrivateKey) *KeyPair {
+	return &KeyPair{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+}
+
+// The serial number of a PEM encoded certificate, in hex.
+func SerialNumber(certPEM []byte) (string, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", ErrBadPEM
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%X", cert.SerialNumber), nil
+}
+
+// The SHA-256 fingerprint of a PEM encoded certificate, as colon separated hex.
+func Fingerprint(certPEM []byte) (string, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", ErrBadPEM
+	}
+	sum := sha256.Sum256(block.Bytes)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":"), nil
+}
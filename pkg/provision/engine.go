@@ -0,0 +1,146 @@
+package provision
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultEnginePort       = 2376
+	DefaultEngineInstallURL = "https://get.docker.com"
+
+	// Where the engine finds its certificates on the machine.
+	EngineCertDir = "/etc/docker"
+
+	engineDropIn = "/etc/systemd/system/docker.service.d/10-kat-machine.conf"
+)
+
+var (
+	ErrBadEngineOption = errors.New("err-bad-engine-option")
+)
+
+// How the Docker engine is installed and configured on a machine.
+type EngineOptions struct {
+	// Script that installs the engine when it is not there yet.
+	InstallURL string `json:"install_url,omitempty"`
+
+	Port               int               `json:"port,omitempty"`
+	StorageDriver      string            `json:"storage_driver,omitempty"`
+	Labels             map[string]string `json:"labels,omitempty"`
+	InsecureRegistries []string          `json:"insecure_registries,omitempty"`
+	RegistryMirrors    []string          `json:"registry_mirrors,omitempty"`
+
+	// More arguments for the daemon, as given.
+	Args []string `json:"args,omitempty"`
+}
+
+// Fills in the defaults and checks the values that end up in shell commands.
+func (o *EngineOptions) Normalize() error {
+	if o.InstallURL == "" {
+		o.InstallURL = DefaultEngineInstallURL
+	}
+	if o.Port == 0 {
+		o.Port = DefaultEnginePort
+	}
+	if o.Port < 0 || o.Port > 65535 {
+		return fmt.Errorf("%s:port:%d", ErrBadEngineOption, o.Port)
+	}
+	// The script is run as root, so it must come from where it says it does.
+	if !strings.HasPrefix(o.InstallURL, "https://") {
+		return fmt.Errorf("%s:install_url", ErrBadEngineOption)
+	}
+	// The daemon arguments are written by a shell script into a systemd unit, which has its
+	// own quoting.
+	values := []string{o.StorageDriver}
+	for k, v := range o.Labels {
+		values = append(values, k, v)
+	}
+	values = append(values, o.InsecureRegistries...)
+	values = append(values, o.RegistryMirrors...)
+	values = append(values, o.Args...)
+	for _, v := range values {
+		if strings.ContainsAny(v, "'\"$`\\\n%") {
+			return fmt.Errorf("%s:%s", ErrBadEngineOption, v)
+		}
+	}
+	return nil
+}
+
+// The command that installs the engine unless it is already installed.
+func (o EngineOptions) InstallCommand() string {
+	url := shellQuote(o.InstallURL)
+	return "if ! command -v docker >/dev/null; then\n" +
+		"  if command -v curl >/dev/null; then curl -fsSL " + url + " | sh\n" +
+		"  else wget -qO- " + url + " | sh; fi\n" +
+		"fi\n"
+}
+
+// The files the engine needs for TLS, by path on the machine.
+func EngineCertFiles(caCert []byte, server *KeyPair) map[string][]byte {
+	return map[string][]byte{
+		EngineCertDir + "/ca.pem":         caCert,
+		EngineCertDir + "/server.pem":     server.Cert,
+		EngineCertDir + "/server-key.pem": server.Key,
+	}
+}
+
+// The command that points the engine at its certificates and has it listen on the port with
+// client certificates required.  The unit is overridden with a systemd drop-in, as
+// docker-machine does.
+func (o EngineOptions) ConfigureCommand() string {
+	args := []string{
+		"-H", "tcp://0.0.0.0:" + fmt.Sprint(o.Port),
+		"-H", "unix:///var/run/docker.sock",
+		"--tlsverify",
+		"--tlscacert", EngineCertDir + "/ca.pem",
+		"--tlscert", EngineCertDir + "/server.pem",
+		"--tlskey", EngineCertDir + "/server-key.pem",
+	}
+	if o.StorageDriver != "" {
+		args = append(args, "--storage-driver", o.StorageDriver)
+	}
+	keys := []string{}
+	for k := range o.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--label", k+"="+o.Labels[k])
+	}
+	for _, r := range o.InsecureRegistries {
+		args = append(args, "--insecure-registry", r)
+	}
+	for _, r := range o.RegistryMirrors {
+		args = append(args, "--registry-mirror", r)
+	}
+	args = append(args, o.Args...)
+
+	quoted := []string{}
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	// The arguments go in a quoted heredoc so that nothing in them is expanded by the shell.
+	return "set -e\n" +
+		"mkdir -p " + parentDir(engineDropIn) + "\n" +
+		"DOCKERD=$(command -v dockerd || echo /usr/bin/dockerd)\n" +
+		"{ printf '[Service]\\nExecStart=\\nExecStart=%s ' \"$DOCKERD\"; cat <<'EOF'; } > " + engineDropIn + "\n" +
+		strings.Join(quoted, " ") + "\n" +
+		"EOF\n" +
+		"systemctl daemon-reload\n" +
+		"systemctl enable docker\n" +
+		"systemctl restart docker\n"
+}
+
+// The directory of a file path.
+func parentDir(file string) string {
+	if i := strings.LastIndex(file, "/"); i > 0 {
+		return file[:i]
+	}
+	return "/"
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,53 @@
+package provision
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEngineNormalize(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		options EngineOptions
+		ok      bool
+	}{
+		{"defaults", EngineOptions{}, true},
+		{"own install script", EngineOptions{InstallURL: "https://example.com/install.sh"}, true},
+		{"install script over http", EngineOptions{InstallURL: "http://example.com/install.sh"}, false},
+		{"install script from a file", EngineOptions{InstallURL: "file:///tmp/install.sh"}, false},
+		{"port out of range", EngineOptions{Port: 70000}, false},
+		{"negative port", EngineOptions{Port: -1}, false},
+		{"plain values", EngineOptions{StorageDriver: "overlay2", Labels: map[string]string{"env": "ci"},
+			Args: []string{"--debug"}}, true},
+		{"quote in a label", EngineOptions{Labels: map[string]string{"env": "c'i"}}, false},
+		{"expansion in an arg", EngineOptions{Args: []string{"--data-root=$HOME"}}, false},
+		{"newline in a mirror", EngineOptions{RegistryMirrors: []string{"https://m\nrm -rf /"}}, false},
+		{"percent for systemd", EngineOptions{StorageDriver: "%h"}, false},
+	} {
+		err := c.options.Normalize()
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+
+	o := EngineOptions{}
+	o.Normalize()
+	if o.InstallURL != DefaultEngineInstallURL || o.Port != DefaultEnginePort {
+		t.Errorf("defaults: got %+v", o)
+	}
+}
+
+func TestEngineConfigureCommand(t *testing.T) {
+	o := EngineOptions{Port: 2377, Labels: map[string]string{"b": "2", "a": "1"}}
+	cmd := o.ConfigureCommand()
+	for _, want := range []string{
+		"'tcp://0.0.0.0:2377'",
+		"'--tlsverify'",
+		"'--label' 'a=1' '--label' 'b=2'",
+		"cat <<'EOF'; } > " + engineDropIn,
+	} {
+		if !strings.Contains(cmd, want) {
+			t.Errorf("no %q in %s", want, cmd)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package provision
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	DefaultSwarmImage    = "swarm:1.2.9"
+	DefaultSwarmPort     = 3376
+	DefaultSwarmStrategy = "spread"
+
+	// Where the swarm manager finds its certificates on the master.
+	SwarmCertDir = "/etc/docker/swarm"
+
+	// The container names docker-machine gives the manager and the agents.
+	swarmManagerName = "swarm-agent-master"
+	swarmAgentName   = "swarm-agent"
+)
+
+var (
+	ErrBadSwarmOption = errors.New("err-bad-swarm-option")
+
+	swarmStrategies  = []string{"spread", "binpack", "random"}
+	swarmDiscoveries = []string{"token://", "consul://", "etcd://", "zk://"}
+)
+
+// How swarm is run on the machines of a cluster.
+type SwarmOptions struct {
+	Image    string `json:"image,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Strategy string `json:"strategy,omitempty"`
+
+	// The discovery backend the agents register with, such as consul://host:8500/path.
+	// Without one the manager is given the list of nodes, and restarted as it changes.
+	Discovery string `json:"discovery,omitempty"`
+
+	// More arguments for the manager, as given.
+	Args []string `json:"args,omitempty"`
+}
+
+// Fills in the defaults and checks the values.
+func (o *SwarmOptions) Normalize() error {
+	if o.Image == "" {
+		o.Image = DefaultSwarmImage
+	}
+	if o.Port == 0 {
+		o.Port = DefaultSwarmPort
+	}
+	if o.Strategy == "" {
+		o.Strategy = DefaultSwarmStrategy
+	}
+	if o.Port < 0 || o.Port > 65535 {
+		return fmt.Errorf("%s:port:%d", ErrBadSwarmOption, o.Port)
+	}
+	if !oneOf(o.Strategy, swarmStrategies, false) {
+		return fmt.Errorf("%s:strategy:%s", ErrBadSwarmOption, o.Strategy)
+	}
+	if o.Discovery != "" && !oneOf(o.Discovery, swarmDiscoveries, true) {
+		return fmt.Errorf("%s:discovery:%s", ErrBadSwarmOption, o.Discovery)
+	}
+	return nil
+}
+
+// Tells if the manager keeps the list of nodes itself, rather than agents joining through a
+// discovery backend.
+func (o SwarmOptions) StaticDiscovery() bool {
+	return o.Discovery == ""
+}
+
+// The files the manager needs for TLS, by path on the master.  The certificate is presented
+// both to the clients of the manager and to the engines it manages.
+func SwarmCertFiles(caCert []byte, manager *KeyPair) map[string][]byte {
+	return map[string][]byte{
+		SwarmCertDir + "/ca.pem":   caCert,
+		SwarmCertDir + "/cert.pem": manager.Cert,
+		SwarmCertDir + "/key.pem":  manager.Key,
+	}
+}
+
+// The command that (re)starts the manager on the master.  The nodes, as host:port of their
+// engines, are only used with static discovery.
+func (o SwarmOptions) ManageCommand(nodes []string) string {
+	discovery := o.Discovery
+	if o.StaticDiscovery() {
+		discovery = "nodes://" + strings.Join(nodes, ",")
+	}
+	args := []string{
+		"manage",
+		"--tlsverify",
+		"--tlscacert", SwarmCertDir + "/ca.pem",
+		"--tlscert", SwarmCertDir + "/cert.pem",
+		"--tlskey", SwarmCertDir + "/key.pem",
+		"-H", fmt.Sprintf("tcp://0.0.0.0:%d", DefaultSwarmPort),
+		"--strategy", o.Strategy,
+	}
+	args = append(args, o.Args...)
+	args = append(args, discovery)
+	return "docker rm -f " + swarmManagerName + " >/dev/null 2>&1 || true\n" +
+		"docker run -d --restart=always --name " + swarmManagerName +
+		fmt.Sprintf(" -p %d:%d", o.Port, DefaultSwarmPort) +
+		" -v " + SwarmCertDir + ":" + SwarmCertDir + ":ro " +
+		shellQuote(o.Image) + " " + quoteAll(args) + "\n"
+}
+
+// The command that starts the agent on a node, advertising the host:port of its engine.
+func (o SwarmOptions) JoinCommand(advertise string) string {
+	args := []string{"join", "--advertise", advertise, o.Discovery}
+	return "docker rm -f " + swarmAgentName + " >/dev/null 2>&1 || true\n" +
+		"docker run -d --restart=always --name " + swarmAgentName + " " +
+		shellQuote(o.Image) + " " + quoteAll(args) + "\n"
+}
+
+// The command that stops swarm on a node, the manager as well when the node is the master.
+func (o SwarmOptions) LeaveCommand(master bool) string {
+	names := swarmAgentName
+	if master {
+		names += " " + swarmManagerName
+	}
+	return "docker rm -f " + names + " >/dev/null 2>&1 || true\n"
+}
+
+func oneOf(v string, list []string, prefix bool) bool {
+	for _, l := range list {
+		if v == l || (prefix && strings.HasPrefix(v, l) && len(v) > len(l)) {
+			return true
+		}
+	}
+	return false
+}
+
+func quoteAll(args []string) string {
+	quoted := []string{}
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
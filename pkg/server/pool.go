@@ -0,0 +1,50 @@
+package server
+
+import (
+	"github.com/conductant/gohm/pkg/server"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Same as the default of the gohm service builder.
+	DefaultShutdownTimeout = 10 * time.Second
+)
+
+// Serves each request with an engine that is not serving another.  A gohm engine serves one
+// request at a time, so a stream, a shell or a wait would otherwise hold up every other
+// request, including the one that cancels it.  Engines are built as needed and kept for
+// reuse, so there are as many as the most requests served at once.
+type enginePool struct {
+	build func() server.Server
+
+	free []server.Server
+	lock sync.Mutex
+}
+
+func (p *enginePool) get() server.Server {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if n := len(p.free); n > 0 {
+		engine := p.free[n-1]
+		p.free = p.free[:n-1]
+		return engine
+	}
+	return nil
+}
+
+func (p *enginePool) put(engine server.Server) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.free = append(p.free, engine)
+}
+
+func (p *enginePool) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	engine := p.get()
+	if engine == nil {
+		engine = p.build()
+	}
+	defer p.put(engine)
+	engine.ServeHTTP(resp, req)
+}
@@ -7,12 +7,39 @@ import (
 	"github.com/conductant/kat-machine/pkg/machine"
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
 	"net/http"
+	"time"
 )
 
 type ServerOptions struct {
 	Port         int    `json:"port" yaml:"port" flag:"port, The server listening port"`
 	PublicKeyUrl string `json:"public_key_url,omitempty" yaml:"public_key_url" flag:"public_key_url,Url for fetching the public key for auth token"`
+
+	AccountsUrl string `json:"accounts_url,omitempty" yaml:"accounts_url" flag:"accounts_url,Url for fetching the yaml provider accounts by name"`
+
+	SecretKeyUrl string `json:"secret_key_url,omitempty" yaml:"secret_key_url" flag:"secret_key_url,Url for fetching the key material secrets are encrypted with"`
+
+	RetryPolicyUrl string `json:"retry_policy_url,omitempty" yaml:"retry_policy_url" flag:"retry_policy_url,Url for fetching the yaml retry policies by driver"`
+
+	CreateTimeout time.Duration `json:"create_timeout,omitempty" yaml:"create_timeout" flag:"create_timeout,Deadline for creating a machine"`
+	ActionTimeout time.Duration `json:"action_timeout,omitempty" yaml:"action_timeout" flag:"action_timeout,Deadline for starting or stopping or restarting or killing a machine"`
+	RemoveTimeout time.Duration `json:"remove_timeout,omitempty" yaml:"remove_timeout" flag:"remove_timeout,Deadline for removing a machine"`
+	StateTimeout  time.Duration `json:"state_timeout,omitempty" yaml:"state_timeout" flag:"state_timeout,Deadline for getting the state of a machine"`
+
+	RemovedRetention time.Duration `json:"removed_retention,omitempty" yaml:"removed_retention" flag:"removed_retention,How long removed machines are kept before they are purged"`
+
+	ReaperInterval  time.Duration `json:"reaper_interval,omitempty" yaml:"reaper_interval" flag:"reaper_interval,How often expired machines are looked for"`
+	ExpiryWarning   time.Duration `json:"expiry_warning,omitempty" yaml:"expiry_warning" flag:"expiry_warning,How long before expiry the warning event is sent"`
+	EventWebhookUrl string        `json:"event_webhook_url,omitempty" yaml:"event_webhook_url" flag:"event_webhook_url,Url events are posted to"`
+
+	HealthInterval time.Duration `json:"health_interval,omitempty" yaml:"health_interval" flag:"health_interval,How often the health of machines is checked"`
+
+	ClientCertTTL time.Duration `json:"client_cert_ttl,omitempty" yaml:"client_cert_ttl" flag:"client_cert_ttl,How long the client certificates of certs.zip are valid"`
+
+	ProvisionStepTimeout time.Duration `json:"provision_step_timeout,omitempty" yaml:"provision_step_timeout" flag:"provision_step_timeout,Deadline for each provisioning step"`
+
+	ShellOrigins []string `json:"shell_origins,omitempty" yaml:"shell_origins" flag:"shell_origins,Origins of other sites allowed to open shells"`
 }
 
 type Server struct {
@@ -22,7 +49,57 @@ type Server struct {
 }
 
 func (this *Server) Init() error {
+	machine.SetOperationTimeouts(map[string]time.Duration{
+		"create":  this.CreateTimeout,
+		"start":   this.ActionTimeout,
+		"stop":    this.ActionTimeout,
+		"restart": this.ActionTimeout,
+		"kill":    this.ActionTimeout,
+		"remove":  this.RemoveTimeout,
+		"state":   this.StateTimeout,
+	})
+
+	machine.SetEventWebhook(this.EventWebhookUrl)
+	machine.SetClientCertTTL(this.ClientCertTTL)
+	machine.SetProvisionStepTimeout(this.ProvisionStepTimeout)
+	machine.SetShellOrigins(this.ShellOrigins)
+
+	if this.AccountsUrl != "" {
+		buff, err := resource.Fetch(context.Background(), this.AccountsUrl)
+		if err != nil {
+			return err
+		}
+		accounts := map[string]machine.Account{}
+		if err := yaml.Unmarshal(buff, &accounts); err != nil {
+			return err
+		}
+		if err := machine.SetAccounts(accounts); err != nil {
+			return err
+		}
+	}
+
+	if this.SecretKeyUrl != "" {
+		buff, err := resource.Fetch(context.Background(), this.SecretKeyUrl)
+		if err != nil {
+			return err
+		}
+		machine.SetSecretKey(buff)
+	}
+
+	if this.RetryPolicyUrl != "" {
+		buff, err := resource.Fetch(context.Background(), this.RetryPolicyUrl)
+		if err != nil {
+			return err
+		}
+		policies := map[string]machine.RetryPolicy{}
+		if err := yaml.Unmarshal(buff, &policies); err != nil {
+			return err
+		}
+		machine.SetRetryPolicies(policies)
+	}
+
 	// TODO - this is just for dev
+	machine.SetAuthDisabled(this.PublicKeyUrl == "")
 	if this.PublicKeyUrl == "" {
 		return nil
 	}
@@ -36,15 +113,47 @@ func (this *Server) Init() error {
 }
 
 func (this *Server) Start() <-chan error {
+	stopPurge := machine.StartPurge(this.RemovedRetention, machine.DefaultPurgeInterval)
+	stopReaper := machine.StartReaper(this.ReaperInterval, this.ExpiryWarning)
+	stopScheduler := machine.StartScheduler(machine.DefaultScheduleInterval)
+	stopHealth := machine.StartHealthChecks(this.HealthInterval)
+
 	shutdown := make(chan struct{})
-	stop, stopped := server.NewService().
-		WithAuth(
-			server.Auth{
-				VerifyKeyFunc: func() []byte {
-					return this.publicKey
-				},
-			}.Init()).
-		ListenPort(this.Port).
+	auth := server.DisableAuth()
+	if this.PublicKeyUrl != "" {
+		auth = server.Auth{
+			VerifyKeyFunc: func() []byte {
+				return this.publicKey
+			},
+		}.Init()
+	}
+	pool := &enginePool{
+		build: func() server.Server {
+			return this.buildEngine(auth, shutdown)
+		},
+	}
+	stop, stopped := server.Start(this.Port, pool,
+		func() error {
+			glog.Infoln("Executing user custom shutdown...")
+			stopPurge()
+			stopReaper()
+			stopScheduler()
+			stopHealth()
+			return nil
+		}, DefaultShutdownTimeout)
+
+	// For stopping the server
+	go func() {
+		<-shutdown
+		stop <- 1
+	}()
+	return stopped
+}
+
+// Builds an engine with the routes of the api.
+func (this *Server) buildEngine(auth server.AuthManager, shutdown chan struct{}) server.Server {
+	return server.NewService().
+		WithAuth(auth).
 		Route(
 			server.Endpoint{
 				UrlRoute:   "/info",
@@ -63,6 +172,13 @@ func (this *Server) Start() <-chan error {
 				AuthScope:  server.AuthScopeNone,
 			}).
 		To(machine.ListDrivers).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/account/",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScopeNone,
+			}).
+		To(machine.ListAccounts).
 		Route(
 			server.Endpoint{
 				UrlRoute:   "/v1/driver/{driver}/options",
@@ -74,21 +190,88 @@ func (this *Server) Start() <-chan error {
 			server.Endpoint{
 				UrlRoute:   "/v1/machine/{driver}/{name}",
 				HttpMethod: server.POST,
-				AuthScope:  server.AuthScopeNone,
+				UrlQueries: server.UrlQueries{
+					"wait":         "", // Running | Stopped | ...
+					"timeout":      "", // e.g. 5m
+					"wait_for_ssh": false,
+					"dry_run":      false,
+				},
+				AuthScope: server.AuthScopeNone,
 			}).
 		To(machine.CreateInstance).
 		Route(
 			server.Endpoint{
-				UrlRoute:   "/v1/host/",
+				UrlRoute:   "/v1/machine/from-template/{template}/{name}",
+				HttpMethod: server.POST,
+				UrlQueries: server.UrlQueries{
+					"version":      0, // latest if not set
+					"wait":         "",
+					"timeout":      "",
+					"wait_for_ssh": false,
+					"dry_run":      false,
+				},
+				AuthScope: server.AuthScopeNone,
+			}).
+		To(machine.CreateFromTemplate).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/template/",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScopeNone,
+			}).
+		To(machine.ListTemplates).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/template/{template}",
+				HttpMethod: server.POST,
+				AuthScope:  server.AuthScope(machine.TemplateScope),
+			}).
+		To(machine.SaveTemplate).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/template/{template}",
+				HttpMethod: server.GET,
+				UrlQueries: server.UrlQueries{
+					"version": 0,
+				},
+				AuthScope: server.AuthScopeNone,
+			}).
+		To(machine.GetTemplate).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/template/{template}/versions",
 				HttpMethod: server.GET,
 				AuthScope:  server.AuthScopeNone,
 			}).
+		To(machine.ListTemplateVersions).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/template/{template}",
+				HttpMethod: server.DELETE,
+				AuthScope:  server.AuthScope(machine.TemplateScope),
+			}).
+		To(machine.RemoveTemplate).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/",
+				HttpMethod: server.GET,
+				UrlQueries: server.UrlQueries{
+					"details":         false,
+					"include_removed": false,
+					"group_by":        "account", // account | driver
+				},
+				AuthScope: server.AuthScopeNone,
+			}).
 		To(machine.ListAllHosts).
 		Route(
 			server.Endpoint{
 				UrlRoute:   "/v1/host/{driver}/",
 				HttpMethod: server.GET,
-				AuthScope:  server.AuthScopeNone,
+				UrlQueries: server.UrlQueries{
+					"details":         false,
+					"include_removed": false,
+				},
+				AuthScope: server.AuthScopeNone,
 			}).
 		To(machine.ListAllHostsByDriver).
 		Route(
@@ -98,12 +281,23 @@ func (this *Server) Start() <-chan error {
 				AuthScope:  server.AuthScopeNone,
 			}).
 		To(machine.GetInstanceState).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/journal",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScopeNone,
+			}).
+		To(machine.GetJournal).
 		Route(
 			server.Endpoint{
 				UrlRoute:   "/v1/host/{driver}/{name}",
 				HttpMethod: server.PUT,
 				UrlQueries: server.UrlQueries{
-					"action": "", // start | stop | restart | kill
+					"action":       "", // start | stop | restart | kill
+					"wait":         "", // Running | Stopped | ...
+					"timeout":      "", // e.g. 5m
+					"wait_for_ssh": false,
+					"dry_run":      false,
 				},
 				AuthScope: server.AuthScopeNone,
 			}).
@@ -115,6 +309,390 @@ func (this *Server) Start() <-chan error {
 				AuthScope:  server.AuthScopeNone,
 			}).
 		To(machine.RemoveInstance).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/clone/{newName}",
+				HttpMethod: server.POST,
+				UrlQueries: server.UrlQueries{
+					"wait":         "",
+					"timeout":      "",
+					"wait_for_ssh": false,
+					"dry_run":      false,
+				},
+				AuthScope: server.AuthScope(machine.CloneScope),
+			}).
+		To(machine.CloneInstance).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/env",
+				HttpMethod: server.GET,
+				UrlQueries: server.UrlQueries{
+					"shell":     "", // bash, fish or json
+					"cert_path": "",
+				},
+				AuthScope: server.AuthScopeNone,
+			}).
+		To(machine.GetDockerEnv).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/certs.zip",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScope(machine.DockerClientScope),
+			}).
+		To(machine.GetClientCerts).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/audit",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScope(machine.AuditScope),
+			}).
+		To(machine.GetAudit).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/docker/{path:.*}",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScope(machine.DockerProxyScope),
+			}).
+		To(machine.ProxyDocker).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/docker/{path:.*}",
+				HttpMethod: server.HEAD,
+				AuthScope:  server.AuthScope(machine.DockerProxyScope),
+			}).
+		To(machine.ProxyDocker).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/docker/{path:.*}",
+				HttpMethod: server.POST,
+				AuthScope:  server.AuthScope(machine.DockerProxyScope),
+			}).
+		To(machine.ProxyDocker).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/docker/{path:.*}",
+				HttpMethod: server.PUT,
+				AuthScope:  server.AuthScope(machine.DockerProxyScope),
+			}).
+		To(machine.ProxyDocker).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/docker/{path:.*}",
+				HttpMethod: server.DELETE,
+				AuthScope:  server.AuthScope(machine.DockerProxyScope),
+			}).
+		To(machine.ProxyDocker).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/exec",
+				HttpMethod: server.POST,
+				UrlQueries: server.UrlQueries{
+					"command": "", // with the body as stdin
+					"timeout": "",
+					"stream":  "", // sse for server-sent events
+				},
+				AuthScope: server.AuthScope(machine.ExecScope),
+			}).
+		To(machine.ExecCommand).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/shell",
+				HttpMethod: server.GET,
+				UrlQueries: server.UrlQueries{
+					"cols":   80,
+					"rows":   24,
+					"term":   "xterm",
+					"idle":   "", // e.g. 15m
+					"record": false,
+				},
+				AuthScope: server.AuthScope(machine.ShellScope),
+			}).
+		To(machine.OpenShell).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/sessions/",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScope(machine.ShellScope),
+			}).
+		To(machine.ListSessions).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/sessions/{id}",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScope(machine.ShellScope),
+			}).
+		To(machine.GetSession).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/files",
+				HttpMethod: server.GET,
+				UrlQueries: server.UrlQueries{
+					"path": "",
+					"sudo": false,
+				},
+				AuthScope: server.AuthScope(machine.FilesScope),
+			}).
+		To(machine.GetFile).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/files",
+				HttpMethod: server.PUT,
+				UrlQueries: server.UrlQueries{
+					"path":    "",
+					"mode":    "", // octal, e.g. 0600
+					"archive": "", // tar to unpack into a directory
+					"sudo":    false,
+				},
+				AuthScope: server.AuthScope(machine.FilesScope),
+			}).
+		To(machine.PutFile).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/ssh-key",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScopeNone,
+			}).
+		To(machine.GetSSHKey).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/ssh-key/rotate",
+				HttpMethod: server.POST,
+				AuthScope:  server.AuthScope(machine.KeyScope),
+			}).
+		To(machine.RotateSSHKey).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/health",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScopeNone,
+			}).
+		To(machine.GetHealth).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/health",
+				HttpMethod: server.POST,
+				AuthScope:  server.AuthScope(machine.HealthScope),
+			}).
+		To(machine.CheckHealth).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/health/probes",
+				HttpMethod: server.PUT,
+				AuthScope:  server.AuthScope(machine.HealthScope),
+			}).
+		To(machine.SetHealthProbes).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/protection",
+				HttpMethod: server.PUT,
+				UrlQueries: server.UrlQueries{
+					"protected": false,
+				},
+				AuthScope: server.AuthScope(machine.ProtectScope),
+			}).
+		To(machine.SetProtection).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/expiry",
+				HttpMethod: server.PUT,
+				UrlQueries: server.UrlQueries{
+					"ttl":        "", // e.g. 72h from now
+					"extend":     "", // e.g. 24h added to the current expiry
+					"expires_at": "", // RFC3339
+					"action":     "", // stop | remove
+				},
+				AuthScope: server.AuthScope(machine.ExpiryScope),
+			}).
+		To(machine.SetExpiry).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/host/{driver}/{name}/expiry",
+				HttpMethod: server.DELETE,
+				AuthScope:  server.AuthScope(machine.ExpiryScope),
+			}).
+		To(machine.ClearExpiry).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/event/",
+				HttpMethod: server.GET,
+				UrlQueries: server.UrlQueries{
+					"since": "", // RFC3339
+					"type":  "", // e.g. expiry-warning
+				},
+				AuthScope: server.AuthScopeNone,
+			}).
+		To(machine.ListEvents).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/bulk/machine/{driver}",
+				HttpMethod: server.POST,
+				UrlQueries: server.UrlQueries{
+					"name":         "", // e.g. ci-{n}
+					"count":        1,
+					"start":        1,
+					"parallelism":  machine.DefaultBulkParallelism,
+					"mode":         machine.BulkModeStop, // stop | continue
+					"async":        false,
+					"wait":         "",
+					"timeout":      "",
+					"wait_for_ssh": false,
+					"dry_run":      false,
+				},
+				AuthScope: server.AuthScope(machine.BulkScope),
+			}).
+		To(machine.BulkCreate).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/bulk/host/",
+				HttpMethod: server.PUT,
+				UrlQueries: server.UrlQueries{
+					"selector":     "", // e.g. env=staging,team=ci
+					"driver":       "",
+					"action":       "", // start | stop | restart | kill
+					"parallelism":  machine.DefaultBulkParallelism,
+					"mode":         machine.BulkModeStop,
+					"async":        false,
+					"wait":         "",
+					"timeout":      "",
+					"wait_for_ssh": false,
+					"dry_run":      false,
+				},
+				AuthScope: server.AuthScope(machine.BulkScope),
+			}).
+		To(machine.BulkAction).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/bulk/",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScopeNone,
+			}).
+		To(machine.ListBulkOperations).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/bulk/{id}",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScopeNone,
+			}).
+		To(machine.GetBulkOperation).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/bulk/{id}",
+				HttpMethod: server.DELETE,
+				AuthScope:  server.AuthScope(machine.BulkScope),
+			}).
+		To(machine.CancelBulkOperation).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/ca/",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScopeNone,
+			}).
+		To(machine.GetCACert).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/cluster/",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScopeNone,
+			}).
+		To(machine.ListClusters).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/cluster/{cluster}",
+				HttpMethod: server.POST,
+				AuthScope:  server.AuthScope(machine.ClusterScope),
+			}).
+		To(machine.CreateCluster).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/cluster/{cluster}",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScopeNone,
+			}).
+		To(machine.GetCluster).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/cluster/{cluster}",
+				HttpMethod: server.DELETE,
+				AuthScope:  server.AuthScope(machine.ClusterScope),
+			}).
+		To(machine.RemoveCluster).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/cluster/{cluster}/node/{driver}/{name}",
+				HttpMethod: server.PUT,
+				AuthScope:  server.AuthScope(machine.ClusterScope),
+			}).
+		To(machine.AddClusterNode).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/cluster/{cluster}/node/{driver}/{name}",
+				HttpMethod: server.DELETE,
+				AuthScope:  server.AuthScope(machine.ClusterScope),
+			}).
+		To(machine.RemoveClusterNode).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/secret/",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScope(machine.SecretAdminScope),
+			}).
+		To(machine.ListSecrets).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/secret/{name}",
+				HttpMethod: server.POST,
+				AuthScope:  server.AuthScope(machine.SecretAdminScope),
+			}).
+		To(machine.PutSecret).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/secret/{name}",
+				HttpMethod: server.DELETE,
+				AuthScope:  server.AuthScope(machine.SecretAdminScope),
+			}).
+		To(machine.RemoveSecret).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/schedule/",
+				HttpMethod: server.POST,
+				AuthScope:  server.AuthScope(machine.ScheduleScope),
+			}).
+		To(machine.CreateSchedule).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/schedule/",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScopeNone,
+			}).
+		To(machine.ListSchedules).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/schedule/{id}",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScopeNone,
+			}).
+		To(machine.GetSchedule).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/schedule/{id}",
+				HttpMethod: server.DELETE,
+				AuthScope:  server.AuthScope(machine.ScheduleScope),
+			}).
+		To(machine.RemoveSchedule).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/operation/",
+				HttpMethod: server.GET,
+				AuthScope:  server.AuthScopeNone,
+			}).
+		To(machine.ListOperations).
+		Route(
+			server.Endpoint{
+				UrlRoute:   "/v1/operation/{id}",
+				HttpMethod: server.DELETE,
+				AuthScope:  server.AuthScope(machine.OperationScope),
+			}).
+		To(machine.CancelOperation).
 		Route(
 			server.Endpoint{
 				UrlRoute:   "/quitquitquit",
@@ -126,17 +704,5 @@ func (this *Server) Start() <-chan error {
 				glog.Infoln("Stopping the server....")
 				close(shutdown)
 			}).
-		OnShutdown(
-			func() error {
-				glog.Infoln("Executing user custom shutdown...")
-				return nil
-			}).
-		Start()
-
-	// For stopping the server
-	go func() {
-		<-shutdown
-		stop <- 1
-	}()
-	return stopped
+		Build()
 }
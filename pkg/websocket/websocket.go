@@ -0,0 +1,293 @@
+// Package websocket is the server side of RFC 6455, as much of it as the server needs:
+// the upgrade handshake, masked client frames, fragmented messages and the control frames.
+// Extensions and subprotocols are not negotiated.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ContinuationMessage = 0
+	TextMessage         = 1
+	BinaryMessage       = 2
+	CloseMessage        = 8
+	PingMessage         = 9
+	PongMessage         = 10
+
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseTooLarge      = 1009
+	CloseInternalError = 1011
+
+	// Largest message accepted from the client.
+	DefaultMaxMessageSize = 1024 * 1024
+
+	acceptGUID   = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	ErrNotWebSocket  = errors.New("err-not-websocket")
+	ErrBadVersion    = errors.New("err-bad-websocket-version")
+	ErrNotHijackable = errors.New("err-not-hijackable")
+	ErrBadOrigin     = errors.New("err-websocket-origin")
+	ErrProtocol      = errors.New("err-websocket-protocol")
+	ErrTooLarge      = errors.New("err-websocket-message-too-large")
+	ErrClosed        = errors.New("err-websocket-closed")
+)
+
+// A websocket connection.  Reads are for one goroutine at a time; writes may come from any.
+type Conn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	MaxMessageSize int
+
+	writeLock sync.Mutex
+	closeSent bool
+}
+
+// Completes the handshake of a websocket request and takes over its connection.  Errors
+// before the connection is taken over are written to the response.  A browser page can open
+// a websocket to any site, with the cookies and credentials of that site, so only pages from
+// the host the request was sent to or from one of the origins given are let through.
+func Upgrade(resp http.ResponseWriter, req *http.Request, origins []string) (*Conn, error) {
+	if !CheckOrigin(req, origins) {
+		http.Error(resp, ErrBadOrigin.Error(), http.StatusForbidden)
+		return nil, ErrBadOrigin
+	}
+	if req.Method != "GET" || !headerHas(req.Header, "Connection", "upgrade") ||
+		!headerHas(req.Header, "Upgrade", "websocket") {
+		http.Error(resp, ErrNotWebSocket.Error(), http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	if req.Header.Get("Sec-Websocket-Version") != "13" {
+		resp.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(resp, ErrBadVersion.Error(), http.StatusUpgradeRequired)
+		return nil, ErrBadVersion
+	}
+	key := req.Header.Get("Sec-Websocket-Key")
+	if key == "" {
+		http.Error(resp, ErrNotWebSocket.Error(), http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		http.Error(resp, ErrNotHijackable.Error(), http.StatusInternalServerError)
+		return nil, ErrNotHijackable
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	handshake := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return &Conn{conn: conn, br: rw.Reader, MaxMessageSize: DefaultMaxMessageSize}, nil
+}
+
+// Whether the Origin of the request is the host it was sent to or one of the origins given,
+// as scheme://host[:port].  Clients other than browsers send no Origin and are let through.
+func CheckOrigin(req *http.Request, origins []string) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range origins {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host != "" && strings.EqualFold(u.Host, req.Host)
+}
+
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reads the next text or binary message.  Pings are answered and pongs dropped on the way.
+// A close from the client is answered, and then ErrClosed returned.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	opcode := -1
+	message := []byte{}
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case PingMessage:
+			if err := c.WriteMessage(PongMessage, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			code := CloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.WriteClose(code, "")
+			return 0, nil, ErrClosed
+		case ContinuationMessage:
+			if opcode < 0 {
+				return 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+			}
+		case TextMessage, BinaryMessage:
+			if opcode >= 0 {
+				return 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+			}
+			opcode = op
+		default:
+			return 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+		}
+		if len(message)+len(payload) > c.MaxMessageSize {
+			return 0, nil, c.fail(CloseTooLarge, ErrTooLarge)
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.br, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	op := int(header[0] & 0x0f)
+	if header[0]&0x70 != 0 {
+		// No extensions were negotiated, so the reserved bits must be clear.
+		return false, 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+	}
+	if header[1]&0x80 == 0 {
+		// Frames from the client are always masked.
+		return false, 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(c.br, b); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(c.br, b); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(b)
+	}
+	if op >= CloseMessage && (!fin || length > 125) {
+		return false, 0, nil, c.fail(CloseProtocolError, ErrProtocol)
+	}
+	if length > uint64(c.MaxMessageSize) {
+		return false, 0, nil, c.fail(CloseTooLarge, ErrTooLarge)
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(c.br, mask); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// Sends the close for a broken protocol and returns the error.
+func (c *Conn) fail(code int, err error) error {
+	c.WriteClose(code, err.Error())
+	return err
+}
+
+// Writes a message in a single frame.
+func (c *Conn) WriteMessage(op int, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if op == CloseMessage {
+		c.closeSent = true
+	}
+	return c.writeFrame(op, data)
+}
+
+func (c *Conn) writeFrame(op int, data []byte) error {
+	frame := []byte{0x80 | byte(op)}
+	switch n := len(data); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126, byte(n>>8), byte(n))
+	default:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(n))
+		frame = append(append(frame, 127), b...)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	defer c.conn.SetWriteDeadline(time.Time{})
+	if _, err := c.conn.Write(append(frame, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Sends a close frame with the code and reason.  Nothing is sent after it.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	return c.WriteMessage(CloseMessage, append(payload, reason...))
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,224 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Echoes every message back until the client closes.
+func echoServer(origins []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		conn, err := Upgrade(resp, req, origins)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			op, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(op, data); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+// Sends the handshake with the headers given and returns the connection and the response.
+func handshake(t *testing.T, s *httptest.Server, header map[string]string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+func writeClientFrame(t *testing.T, w io.Writer, fin bool, op int, data []byte) {
+	b0 := byte(op)
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	switch n := len(data); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	default:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(n))
+		frame = append(append(frame, 0x80|127), b...)
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, c := range data {
+		frame = append(frame, c^mask[i%4])
+	}
+	if _, err := w.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readServerFrame(t *testing.T, r io.Reader) (int, []byte) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		t.Fatalf("frame from the server not final or masked: %x", header)
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		b := make([]byte, 2)
+		io.ReadFull(r, b)
+		length = uint64(binary.BigEndian.Uint16(b))
+	case 127:
+		b := make([]byte, 8)
+		io.ReadFull(r, b)
+		length = binary.BigEndian.Uint64(b)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return int(header[0] & 0x0f), payload
+}
+
+func TestHandshake(t *testing.T) {
+	s := echoServer(nil)
+	defer s.Close()
+
+	conn, _, resp := handshake(t, s, nil)
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	// The example of RFC 6455 section 1.3.
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("got accept %s", accept)
+	}
+
+	conn2, _, resp := handshake(t, s, map[string]string{"Sec-WebSocket-Version": "8"})
+	defer conn2.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("old version: got status %d", resp.StatusCode)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	s := echoServer([]string{"https://console.example.com"})
+	defer s.Close()
+	host := s.Listener.Addr().String()
+
+	for _, c := range []struct {
+		origin string
+		status int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{"http://" + host, http.StatusSwitchingProtocols},
+		{"https://" + strings.ToUpper(host), http.StatusSwitchingProtocols},
+		{"https://console.example.com", http.StatusSwitchingProtocols},
+		{"https://evil.example.com", http.StatusForbidden},
+		{"https://console.example.com.evil.com", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	} {
+		header := map[string]string{}
+		if c.origin != "" {
+			header["Origin"] = c.origin
+		}
+		conn, _, resp := handshake(t, s, header)
+		conn.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("origin %q: got status %d, want %d", c.origin, resp.StatusCode, c.status)
+		}
+	}
+}
+
+func TestMessages(t *testing.T) {
+	s := echoServer(nil)
+	defer s.Close()
+
+	conn, br, resp := handshake(t, s, nil)
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	// Each length on either side of where the length field grows.
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		data := bytes.Repeat([]byte{'k'}, n)
+		writeClientFrame(t, conn, true, BinaryMessage, data)
+		op, payload := readServerFrame(t, br)
+		if op != BinaryMessage || !bytes.Equal(payload, data) {
+			t.Errorf("length %d: got op %d and %d bytes", n, op, len(payload))
+		}
+	}
+
+	// A fragmented message with a ping between the fragments.
+	writeClientFrame(t, conn, false, TextMessage, []byte("hello "))
+	writeClientFrame(t, conn, true, PingMessage, []byte("p"))
+	writeClientFrame(t, conn, true, ContinuationMessage, []byte("world"))
+	if op, payload := readServerFrame(t, br); op != PongMessage || string(payload) != "p" {
+		t.Errorf("ping: got op %d %q", op, payload)
+	}
+	if op, payload := readServerFrame(t, br); op != TextMessage || string(payload) != "hello world" {
+		t.Errorf("fragments: got op %d %q", op, payload)
+	}
+
+	writeClientFrame(t, conn, true, CloseMessage, []byte{0x03, 0xe8})
+	if op, payload := readServerFrame(t, br); op != CloseMessage || binary.BigEndian.Uint16(payload) != CloseNormal {
+		t.Errorf("close: got op %d %x", op, payload)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	s := echoServer(nil)
+	defer s.Close()
+
+	for _, c := range []struct {
+		name  string
+		frame []byte
+		code  int
+	}{
+		{"unmasked", []byte{0x82, 0x01, 'k'}, CloseProtocolError},
+		{"reserved bit", []byte{0xc2, 0x80, 0, 0, 0, 0}, CloseProtocolError},
+		{"continuation first", []byte{0x80, 0x80, 0, 0, 0, 0}, CloseProtocolError},
+		{"fragmented ping", []byte{0x09, 0x80, 0, 0, 0, 0}, CloseProtocolError},
+		{"too large", []byte{0x82, 0xff, 0, 0, 0, 0, 0, 0x20, 0, 0}, CloseTooLarge},
+	} {
+		conn, br, _ := handshake(t, s, nil)
+		if _, err := conn.Write(c.frame); err != nil {
+			t.Fatal(err)
+		}
+		op, payload := readServerFrame(t, br)
+		if op != CloseMessage || len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != c.code {
+			t.Errorf("%s: got op %d %x", c.name, op, payload)
+		}
+		conn.Close()
+	}
+}